@@ -0,0 +1,433 @@
+// Package client speaks the means-to-an-end price protocol served by
+// MeansToAnEnd/server.
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/server"
+)
+
+// Client is one connection to a price server. It is not safe for concurrent
+// use.
+//
+// The client switches the connection to protocol version 2 before its first
+// request, so that every frame from the server says whether it is a reply or
+// an error frame. Prices and timestamps are still int32 on the client's side.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	upgraded bool
+	offset   int64        // of the next frame sent
+	refused  *ServerError // an insert refused since the last reply
+}
+
+// ServerError is an error frame: the server refused the frame that started
+// at Offset in the connection's input.
+type ServerError struct {
+	Code   server.ErrorCode
+	Offset int64
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server refused frame at offset %d with code %d", e.Offset, e.Code)
+}
+
+// Dial connects to the server at addr.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient speaks the protocol over an established connection.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// upgrade switches the connection to protocol version 2 once.
+func (c *Client) upgrade() error {
+	if c.upgraded {
+		return nil
+	}
+
+	var frame [server.MessageSize]byte
+	frame[0] = server.VersionOperation
+	binary.BigEndian.PutUint32(frame[1:5], uint32(server.Version2))
+	if _, err := c.w.Write(frame[:]); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(c.r, reply[:]); err != nil {
+		return fmt.Errorf("failed to read reply: %w", err)
+	}
+	if version := binary.BigEndian.Uint32(reply[:]); version != uint32(server.Version2) {
+		return fmt.Errorf("server switched to protocol version %d", version)
+	}
+	c.upgraded, c.offset = true, int64(server.MessageSize)
+	return nil
+}
+
+// appendFrame appends a version 2 request and returns its offset.
+func (c *Client) appendFrame(b []byte, op byte, fields ...int64) ([]byte, int64) {
+	b = binary.BigEndian.AppendUint32(b, uint32(1+8*len(fields)))
+	b = append(b, op)
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint64(b, uint64(f))
+	}
+	offset := c.offset
+	c.offset += int64(4 + 1 + 8*len(fields))
+	return b, offset
+}
+
+// send upgrades the connection if need be and writes a request. It returns
+// the request's offset.
+func (c *Client) send(op byte, fields ...int64) (int64, error) {
+	if err := c.upgrade(); err != nil {
+		return 0, err
+	}
+	frame, offset := c.appendFrame(nil, op, fields...)
+	if _, err := c.w.Write(frame); err != nil {
+		return 0, err
+	}
+	return offset, c.w.Flush()
+}
+
+// readReply returns the payload of the reply to the frame at offset, or a
+// *ServerError if that frame was refused. Error frames for earlier frames,
+// which can only be inserts, are kept for takeRefused; notices are skipped.
+func (c *Client) readReply(offset int64) ([]byte, error) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, fmt.Errorf("failed to read reply: %w", err)
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 {
+			return nil, errors.New("unexpected empty frame")
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(c.r, frame); err != nil {
+			return nil, fmt.Errorf("failed to read reply: %w", err)
+		}
+
+		switch frame[0] {
+		case server.ReplyFrame:
+			return frame[1:], nil
+		case server.ErrorFrame:
+			if len(frame) != server.ErrorFrameSize {
+				return nil, fmt.Errorf("unexpected error frame of %d bytes", len(frame))
+			}
+			refused := &ServerError{
+				Code:   server.ErrorCode(binary.BigEndian.Uint32(frame[1:5])),
+				Offset: int64(binary.BigEndian.Uint64(frame[5:13])),
+			}
+			if refused.Offset >= offset {
+				return nil, refused
+			}
+			if c.refused == nil {
+				c.refused = refused
+			}
+		case server.NoticeFrame, server.PushFrame:
+		default:
+			return nil, fmt.Errorf("unexpected frame type %q", frame[0])
+		}
+	}
+}
+
+// ErrInsertRefused wraps the *ServerError of an insert, reported by a later
+// call that otherwise succeeded.
+var ErrInsertRefused = errors.New("earlier insert refused")
+
+// takeRefused returns and forgets the first insert refused since it was
+// last called.
+func (c *Client) takeRefused() error {
+	refused := c.refused
+	c.refused = nil
+	if refused == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrInsertRefused, refused)
+}
+
+// readValue reads the reply to the frame at offset as one price. A price
+// that does not fit an int32 fails with ErrOutOfRange once its reply is
+// read, so the next reply can still be.
+func (c *Client) readValue(offset int64) (int32, error) {
+	reply, err := c.readReply(offset)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) != 8 {
+		return 0, fmt.Errorf("unexpected reply of %d bytes", len(reply))
+	}
+	v := int64(binary.BigEndian.Uint64(reply))
+	if v != int64(int32(v)) {
+		return 0, fmt.Errorf("%w: mean %d", ErrOutOfRange, v)
+	}
+	return int32(v), nil
+}
+
+// Insert stores price at timestamp. Inserts have no reply, so an insert the
+// server refuses is reported by the next call that reads a reply, together
+// with that call's own result, as ErrInsertRefused wrapping a *ServerError
+// with the insert's offset.
+func (c *Client) Insert(timestamp, price int32) error {
+	_, err := c.send(server.InsertOperation, int64(timestamp), int64(price))
+	return err
+}
+
+// Query returns the mean price over minTime <= timestamp <= maxTime. A
+// series filled by version 2 clients can have a mean an int32 cannot hold,
+// which fails with ErrOutOfRange.
+func (c *Client) Query(minTime, maxTime int32) (int32, error) {
+	offset, err := c.send(server.QueryOperation, int64(minTime), int64(maxTime))
+	if err != nil {
+		return 0, err
+	}
+	mean, err := c.readValue(offset)
+	if err != nil {
+		return 0, err
+	}
+	return mean, c.takeRefused()
+}
+
+// Attach switches the connection to the named series shared with other
+// connections and returns the number of prices in it. An empty name returns
+// to the connection's private series.
+func (c *Client) Attach(name string) (int64, error) {
+	if len(name) > server.MaxSeriesName {
+		return 0, fmt.Errorf("series name of %d bytes exceeds limit of %d", len(name), server.MaxSeriesName)
+	}
+	if err := c.upgrade(); err != nil {
+		return 0, err
+	}
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(1+len(name)))
+	frame = append(frame, server.AttachOperation)
+	frame = append(frame, name...)
+	offset := c.offset
+	c.offset += int64(len(frame))
+	if _, err := c.w.Write(frame); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	reply, err := c.readReply(offset)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) != 8 {
+		return 0, fmt.Errorf("unexpected reply of %d bytes", len(reply))
+	}
+	return int64(binary.BigEndian.Uint64(reply)), c.takeRefused()
+}
+
+// Batch collects inserts and queries to send in one pipelined write.
+type Batch struct {
+	c       *Client
+	frames  []byte
+	queries []int64 // indexes among the frames
+	count   int
+}
+
+// Batch starts a batch on the connection. Nothing is sent until Send.
+func (c *Client) Batch() *Batch {
+	return &Batch{c: c}
+}
+
+// Insert adds an insert to the batch.
+func (b *Batch) Insert(timestamp, price int32) {
+	b.frames = binary.BigEndian.AppendUint32(b.frames, 17)
+	b.frames = append(b.frames, server.InsertOperation)
+	b.frames = binary.BigEndian.AppendUint64(b.frames, uint64(timestamp))
+	b.frames = binary.BigEndian.AppendUint64(b.frames, uint64(price))
+	b.count++
+}
+
+// Query adds a query to the batch. Its mean is returned by Send in the order
+// the queries were added.
+func (b *Batch) Query(minTime, maxTime int32) {
+	b.frames = binary.BigEndian.AppendUint32(b.frames, 17)
+	b.frames = append(b.frames, server.QueryOperation)
+	b.frames = binary.BigEndian.AppendUint64(b.frames, uint64(minTime))
+	b.frames = binary.BigEndian.AppendUint64(b.frames, uint64(maxTime))
+	b.queries = append(b.queries, int64(b.count))
+	b.count++
+}
+
+// Len returns the number of frames in the batch.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+// Send writes the batch and returns the reply to every query in it. Replies
+// are read while the batch is written, so a large batch cannot stall on a
+// server waiting for its replies to be read. A refused query, or one whose
+// mean is out of the int32 range, is answered 0 and reported once every
+// reply is read, as a *ServerError or ErrOutOfRange, along with any refused
+// insert. The batch is empty afterwards.
+func (b *Batch) Send() ([]int32, error) {
+	defer func() {
+		b.frames, b.queries, b.count = b.frames[:0], b.queries[:0], 0
+	}()
+	if b.count == 0 {
+		return nil, nil
+	}
+	c := b.c
+	if err := c.upgrade(); err != nil {
+		return nil, err
+	}
+
+	// Every frame in a batch is the same size
+	const frameSize = 4 + 17
+	start := c.offset
+	c.offset += int64(b.count * frameSize)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.w.Write(b.frames)
+		if err == nil {
+			err = c.w.Flush()
+		}
+		written <- err
+	}()
+
+	means := make([]int32, 0, len(b.queries))
+	var readErr, unanswered error // the first query refused or out of range
+	for _, index := range b.queries {
+		mean, err := c.readValue(start + index*frameSize)
+		var refused *ServerError
+		switch {
+		case errors.As(err, &refused), errors.Is(err, ErrOutOfRange):
+			if unanswered == nil {
+				unanswered = err
+			}
+		case err != nil:
+			readErr = err
+		}
+		if readErr != nil {
+			break
+		}
+		means = append(means, mean)
+	}
+
+	writeErr := <-written
+	if writeErr != nil {
+		return means, writeErr
+	}
+	if readErr != nil {
+		return means, readErr
+	}
+	return means, errors.Join(unanswered, c.takeRefused())
+}
+
+// Point is one stored price.
+type Point struct {
+	Timestamp int32 `json:"timestamp"`
+	Price     int32 `json:"price"`
+}
+
+var ErrOutOfRange = errors.New("price or timestamp out of int32 range")
+
+// Export returns the prices with minTime <= timestamp <= maxTime in
+// timestamp order. Only the connection itself can export its private
+// series, so attach to a named series to inspect it from elsewhere. Series
+// filled by version 2 clients can hold values an int32 cannot; exporting
+// one of them fails with ErrOutOfRange.
+func (c *Client) Export(minTime, maxTime int32) ([]Point, error) {
+	offset, err := c.send(server.ExportOperation, int64(minTime), int64(maxTime))
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for {
+		if len(reply) < 4 {
+			return points, errors.New("export ended without an end record")
+		}
+		size := binary.BigEndian.Uint32(reply)
+		reply = reply[4:]
+		if size == 0 {
+			return points, c.takeRefused()
+		}
+		if size != server.V2PointSize || len(reply) < server.V2PointSize {
+			return points, fmt.Errorf("unexpected record of %d bytes", size)
+		}
+		timestamp := int64(binary.BigEndian.Uint64(reply[0:8]))
+		price := int64(binary.BigEndian.Uint64(reply[8:16]))
+		reply = reply[server.V2PointSize:]
+		if timestamp != int64(int32(timestamp)) || price != int64(int32(price)) {
+			return points, fmt.Errorf("%w: %d at %d", ErrOutOfRange, price, timestamp)
+		}
+		points = append(points, Point{Timestamp: int32(timestamp), Price: int32(price)})
+	}
+}
+
+// Import stores points with as few frames as possible and returns how many
+// the server accepted. It stops at the first frame the server did not
+// accept completely.
+func (c *Client) Import(points []Point) (int, error) {
+	if err := c.upgrade(); err != nil {
+		return 0, err
+	}
+
+	accepted := 0
+	for len(points) > 0 {
+		chunk := points[:min(len(points), server.MaxImportPoints)]
+		points = points[len(chunk):]
+
+		frame := binary.BigEndian.AppendUint32(nil, uint32(1+len(chunk)*server.V2PointSize))
+		frame = append(frame, server.ImportOperation)
+		for _, p := range chunk {
+			frame = binary.BigEndian.AppendUint64(frame, uint64(p.Timestamp))
+			frame = binary.BigEndian.AppendUint64(frame, uint64(p.Price))
+		}
+		offset := c.offset
+		c.offset += int64(len(frame))
+		if _, err := c.w.Write(frame); err != nil {
+			return accepted, err
+		}
+		if err := c.w.Flush(); err != nil {
+			return accepted, err
+		}
+
+		reply, err := c.readReply(offset)
+		if err != nil {
+			return accepted, err
+		}
+		if len(reply) != 4 {
+			return accepted, fmt.Errorf("unexpected reply of %d bytes", len(reply))
+		}
+		n := int(binary.BigEndian.Uint32(reply))
+		accepted += n
+		if n < len(chunk) {
+			break
+		}
+	}
+	return accepted, c.takeRefused()
+}
@@ -0,0 +1,221 @@
+package client_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/client"
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/server"
+)
+
+func dial(t *testing.T) *client.Client {
+	t.Helper()
+	c, err := client.Dial("localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestInsertAndQuery(t *testing.T) {
+	c := dial(t)
+	for _, p := range [][2]int32{{1000, 100}, {2000, 200}, {3000, 600}} {
+		if err := c.Insert(p[0], p[1]); err != nil {
+			t.Fatalf("Insert failed: %v", err)
+		}
+	}
+
+	mean, err := c.Query(0, 2500)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if mean != 150 {
+		t.Errorf("Expected mean 150, got %d", mean)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c := dial(t)
+	batch := c.Batch()
+	for i := int32(0); i < 100000; i++ {
+		batch.Insert(i, i%100)
+	}
+	for i := int32(0); i < 50000; i++ {
+		batch.Query(i, i)
+	}
+	if batch.Len() != 150000 {
+		t.Fatalf("Expected 150000 frames, got %d", batch.Len())
+	}
+
+	means, err := batch.Send()
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if len(means) != 50000 {
+		t.Fatalf("Expected 50000 replies, got %d", len(means))
+	}
+	for i, mean := range means {
+		if mean != int32(i%100) {
+			t.Fatalf("Query %d: expected %d, got %d", i, i%100, mean)
+		}
+	}
+
+	if batch.Len() != 0 {
+		t.Errorf("Expected the batch to be empty after Send, got %d frames", batch.Len())
+	}
+	if means, err := batch.Send(); err != nil || len(means) != 0 {
+		t.Errorf("Empty batch returned %v, %v", means, err)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	writer, reader := dial(t), dial(t)
+	name := t.Name() + "-" + time.Now().Format(time.RFC3339Nano)
+
+	if _, err := writer.Attach(name); err != nil {
+		t.Fatalf("Attach failed: %v", err)
+	}
+	writer.Insert(1, 10)
+	writer.Insert(2, 30)
+	if mean, _ := writer.Query(0, 5); mean != 20 {
+		t.Fatalf("Expected mean 20, got %d", mean)
+	}
+
+	count, err := reader.Attach(name)
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 shared prices, got %d: %v", count, err)
+	}
+	if mean, _ := reader.Query(0, 5); mean != 20 {
+		t.Errorf("Expected the reader to see mean 20, got %d", mean)
+	}
+
+	if _, err := reader.Attach(string(make([]byte, 256))); err == nil {
+		t.Error("Expected an error for an oversized name")
+	}
+}
+
+func TestImportAndExport(t *testing.T) {
+	c := dial(t)
+	points := make([]client.Point, 70000)
+	for i := range points {
+		points[i] = client.Point{Timestamp: int32(len(points) - i), Price: int32(i % 7)}
+	}
+
+	accepted, err := c.Import(points)
+	if err != nil || accepted != len(points) {
+		t.Fatalf("Import accepted %d of %d: %v", accepted, len(points), err)
+	}
+
+	exported, err := c.Export(10, 19)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(exported) != 10 {
+		t.Fatalf("Expected 10 points, got %d", len(exported))
+	}
+	for i, p := range exported {
+		want := client.Point{Timestamp: int32(10 + i), Price: int32((len(points) - 10 - i) % 7)}
+		if p != want {
+			t.Errorf("Point %d: expected %+v, got %+v", i, want, p)
+		}
+	}
+
+	if exported, err := c.Export(100000, 200000); err != nil || len(exported) != 0 {
+		t.Errorf("Expected an empty export, got %d points: %v", len(exported), err)
+	}
+}
+
+// fakeServer accepts the version switch on a loopback connection and then
+// answers the nth frame after it with replies[n], which may be nil for none.
+func fakeServer(t *testing.T, replies ...[]byte) *client.Client {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go func() {
+		peer, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			return
+		}
+		defer peer.Close()
+		handshake := make([]byte, server.MessageSize)
+		if _, err := io.ReadFull(peer, handshake); err != nil {
+			return
+		}
+		peer.Write([]byte{0, 0, 0, 2})
+		for _, reply := range replies {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(peer, header); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(peer, make([]byte, binary.BigEndian.Uint32(header))); err != nil {
+				return
+			}
+			if reply != nil {
+				peer.Write(reply)
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client.NewClient(conn)
+}
+
+func frame(typ byte, payload ...byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(1+len(payload))), append([]byte{typ}, payload...)...)
+}
+
+func errorFrame(code server.ErrorCode, offset int64) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	return frame(server.ErrorFrame, binary.BigEndian.AppendUint64(payload, uint64(offset))...)
+}
+
+func TestRefusalsKeepRepliesInSync(t *testing.T) {
+	// An insert at offset 9, then queries at 30 and 51
+	c := fakeServer(t,
+		errorFrame(server.ErrorMemoryBudget, 9),
+		frame(server.ReplyFrame, 0, 0, 0, 0, 0, 0, 0, 42),
+		errorFrame(server.ErrorInvalidRequest, 51),
+	)
+
+	if err := c.Insert(1, 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	mean, err := c.Query(0, 10)
+	var refused *client.ServerError
+	if mean != 42 || !errors.Is(err, client.ErrInsertRefused) || !errors.As(err, &refused) || refused.Code != server.ErrorMemoryBudget || refused.Offset != 9 {
+		t.Fatalf("Expected mean 42 and the refused insert, got %d: %v", mean, err)
+	}
+
+	_, err = c.Query(0, 10)
+	if errors.Is(err, client.ErrInsertRefused) || !errors.As(err, &refused) || refused.Code != server.ErrorInvalidRequest || refused.Offset != 51 {
+		t.Errorf("Expected the refused query, got %v", err)
+	}
+}
+
+func TestQueryRefusesMeanOutOfRange(t *testing.T) {
+	c := fakeServer(t,
+		frame(server.ReplyFrame, binary.BigEndian.AppendUint64(nil, math.MaxInt32+1)...),
+		frame(server.ReplyFrame, 0, 0, 0, 0, 0, 0, 0, 7),
+	)
+
+	if _, err := c.Query(0, 10); !errors.Is(err, client.ErrOutOfRange) {
+		t.Fatalf("Expected ErrOutOfRange, got %v", err)
+	}
+	if mean, err := c.Query(0, 10); mean != 7 || err != nil {
+		t.Errorf("Expected the next reply to be mean 7, got %d: %v", mean, err)
+	}
+}
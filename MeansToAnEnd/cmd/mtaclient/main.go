@@ -0,0 +1,262 @@
+// Command mtaclient loads prices into a means-to-an-end server and queries
+// them.
+//
+//	mtaclient [flags] load FILE                  insert timestamp,price rows from a CSV file
+//	mtaclient [flags] query                      answer queries typed on standard input
+//	mtaclient [flags] export [MINTIME MAXTIME]   write a series as CSV or JSON
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/client"
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/server"
+)
+
+var (
+	addr      string
+	series    string
+	batchSize int
+	format    string
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] load FILE | query | export [MINTIME MAXTIME]\n\n", os.Args[0])
+	fmt.Fprintln(out, "load inserts timestamp,price rows from a CSV file, or standard input for -.")
+	fmt.Fprintln(out, "query reads lines of \"mintime maxtime\" or \"insert timestamp price\".")
+	fmt.Fprintln(out, "export writes the prices of the -series in a range, or all of them, to standard output.")
+	fmt.Fprintln(out)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", "localhost:9000", "Address of the server")
+	flag.StringVar(&series, "series", "", "Named series to attach to; empty uses a private series")
+	flag.IntVar(&batchSize, "batch", server.MaxImportPoints, "Points per import frame when loading")
+	flag.StringVar(&format, "format", "csv", "Export format: csv or json")
+	flag.Usage = usage
+	flag.Parse()
+
+	var run func(*client.Client) error
+	switch args := flag.Args(); {
+	case len(args) == 2 && args[0] == "load":
+		run = func(c *client.Client) error { return load(c, args[1]) }
+	case len(args) == 1 && args[0] == "query":
+		run = func(c *client.Client) error { return query(c, os.Stdin, os.Stdout) }
+	case (len(args) == 1 || len(args) == 3) && args[0] == "export" && (format == "csv" || format == "json"):
+		minTime, maxTime := int32(math.MinInt32), int32(math.MaxInt32)
+		if len(args) == 3 {
+			var err error
+			if minTime, maxTime, err = parsePoint(args[1:]); err != nil {
+				log.Fatalf("Bad export range: %v", err)
+			}
+		}
+		run = func(c *client.Client) error { return export(c, minTime, maxTime, os.Stdout) }
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	if series != "" {
+		count, err := c.Attach(series)
+		if err != nil {
+			log.Fatalf("Failed to attach to %q: %v", series, err)
+		}
+		log.Printf("Attached to %q with %d prices", series, count)
+	}
+
+	if err := run(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// load inserts every row of the CSV file at path, skipping a header row.
+func load(c *client.Client, path string) error {
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var points []client.Point
+	loaded := 0
+	flush := func() error {
+		n, err := c.Import(points)
+		loaded += n
+		if err == nil && n < len(points) {
+			err = fmt.Errorf("server stopped accepting prices after %d", loaded)
+		}
+		points = points[:0]
+		return err
+	}
+
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		timestamp, price, err := parsePoint(record)
+		if err != nil {
+			if line == 1 && isHeader(record) {
+				continue
+			}
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		points = append(points, client.Point{Timestamp: timestamp, Price: price})
+		if len(points) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Printf("Loaded %d prices", loaded)
+	return nil
+}
+
+// export writes the prices in [minTime, maxTime] to out in the -format.
+func export(c *client.Client, minTime, maxTime int32, out io.Writer) error {
+	points, err := c.Export(minTime, maxTime)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if points == nil {
+			points = []client.Point{}
+		}
+		return enc.Encode(points)
+	}
+
+	w := csv.NewWriter(out)
+	w.Write([]string{"timestamp", "price"})
+	for _, p := range points {
+		w.Write([]string{strconv.Itoa(int(p.Timestamp)), strconv.Itoa(int(p.Price))})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func parsePoint(fields []string) (timestamp, price int32, err error) {
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("want 2 fields, got %d", len(fields))
+	}
+	values := make([]int32, 2)
+	for i, field := range fields {
+		v, err := strconv.ParseInt(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		values[i] = int32(v)
+	}
+	return values[0], values[1], nil
+}
+
+// isHeader reports whether record is a header line: one with no numeric
+// field, so that a malformed first row is reported rather than skipped.
+func isHeader(record []string) bool {
+	for _, field := range record {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// query answers each line of in until it is exhausted.
+func query(c *client.Client, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); scanner.Scan(); fmt.Fprint(out, "> ") {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var err error
+		if fields[0] == "insert" {
+			err = runInsert(c, fields[1:])
+		} else {
+			err = runQuery(c, fields, out)
+		}
+
+		// Refusals leave the connection usable, so they are reported like
+		// typing mistakes
+		var numErr *strconv.NumError
+		var refused *client.ServerError
+		if errors.As(err, &numErr) || errors.Is(err, errUsage) ||
+			errors.As(err, &refused) || errors.Is(err, client.ErrOutOfRange) {
+			fmt.Fprintln(out, "error:", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(out)
+	return scanner.Err()
+}
+
+var errUsage = errors.New(`want "mintime maxtime" or "insert timestamp price"`)
+
+func runInsert(c *client.Client, fields []string) error {
+	if len(fields) != 2 {
+		return errUsage
+	}
+	timestamp, price, err := parsePoint(fields)
+	if err != nil {
+		return err
+	}
+	return c.Insert(timestamp, price)
+}
+
+func runQuery(c *client.Client, fields []string, out io.Writer) error {
+	if len(fields) != 2 {
+		return errUsage
+	}
+	minTime, maxTime, err := parsePoint(fields)
+	if err != nil {
+		return err
+	}
+	mean, err := c.Query(minTime, maxTime)
+	// The mean is good even if an earlier insert was refused
+	if err == nil || errors.Is(err, client.ErrInsertRefused) {
+		fmt.Fprintln(out, mean)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsHeader(t *testing.T) {
+	for _, c := range []struct {
+		record []string
+		want   bool
+	}{
+		{[]string{"timestamp", "price"}, true},
+		{[]string{"time"}, true},
+		{[]string{"12", "abc"}, false},
+		{[]string{"abc", " 12"}, false},
+		{[]string{"1.5", "price"}, false},
+		{[]string{"1", "2"}, false},
+	} {
+		if got := isHeader(c.record); got != c.want {
+			t.Errorf("isHeader(%q) = %v, want %v", c.record, got, c.want)
+		}
+	}
+}
+
+func TestLoadReportsMalformedFirstRow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.csv")
+	if err := os.WriteFile(path, []byte("12,abc\n1,10\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The row fails before anything is sent, so no connection is needed
+	err := load(nil, path)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("Expected an error for line 1, got %v", err)
+	}
+}
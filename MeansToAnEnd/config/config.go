@@ -1,4 +1,80 @@
 package config
 
+import "time"
+
 var Host string
 var Port int
+
+// SwapReversedRange restores the old behaviour of answering a query whose
+// mintime is after its maxtime as if the bounds were swapped. The protocol
+// says such a query must return 0, which is the default.
+var SwapReversedRange bool
+
+// DuplicatePolicy names what an insert at an already used timestamp does:
+// overwrite, keep-first, accumulate or reject.
+var DuplicatePolicy string
+
+// DataDir is where named series are stored. Named series are kept in memory
+// only when it is empty.
+var DataDir string
+
+// Fsync names when log writes are synced: always, interval or never.
+var Fsync string
+
+// FsyncInterval is how often logs are synced under the interval policy.
+var FsyncInterval time.Duration
+
+// CompactAfter is the number of log records after which a series is
+// snapshotted and its old log segments are deleted. Zero disables compaction.
+var CompactAfter int
+
+// LogIdleTimeout is how long the log of a persistent series stays open
+// without being written to. Zero keeps logs open.
+var LogIdleTimeout time.Duration
+
+// MaxSeries caps the number of named series. Attaching to a new name past it
+// is refused. Zero is unlimited.
+var MaxSeries int
+
+// SessionLimit caps the points in a connection's private series. Zero is
+// unlimited.
+var SessionLimit int
+
+// SessionLimitPolicy names what an insert past SessionLimit does:
+// reject, evict-oldest or disconnect.
+var SessionLimitPolicy string
+
+// MemoryBudget caps the estimated bytes held by all series together. Zero
+// is unlimited.
+var MemoryBudget int64
+
+// MemoryBudgetPolicy names what an insert past MemoryBudget does:
+// reject, evict-oldest or disconnect.
+var MemoryBudgetPolicy string
+
+// FlushDelay is the longest a reply is held back to be written together with
+// later replies while the client keeps pipelining frames.
+var FlushDelay time.Duration
+
+// MinPushInterval is the shortest time between two pushes of a subscription,
+// whatever interval the client asks for.
+var MinPushInterval time.Duration
+
+// ProtocolErrors names what a frame the server cannot serve leads to:
+// disconnect, report (an error frame, then a disconnect) or skip (an error
+// frame, then the next frame).
+var ProtocolErrors string
+
+// Retention is how far, in timestamp units, a connection's private series
+// reaches back from the newest timestamp inserted on the connection. Older
+// points are dropped in the background. Zero keeps every point.
+var Retention int64
+
+// RetentionInterval is how often points past the retention window are
+// dropped.
+var RetentionInterval time.Duration
+
+// RetentionQueries names how a query reaching past the retention horizon is
+// answered: partial (a notice, for clients that can tell one from the reply,
+// then the reply) or error.
+var RetentionQueries string
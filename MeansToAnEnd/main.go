@@ -4,12 +4,31 @@ import (
 	"flag"
 	"github.com/bhaski-1234/protohackers/MeansToAnEnd/server"
 	"log"
+	"time"
 )
 import "github.com/bhaski-1234/protohackers/MeansToAnEnd/config"
 
 func getFlags() {
 	flag.StringVar(&config.Host, "host", "0.0.0.0", "Host for the application")
 	flag.IntVar(&config.Port, "port", 9000, "Port for the application")
+	flag.BoolVar(&config.SwapReversedRange, "swap-reversed-range", false, "Answer queries with mintime > maxtime by swapping the bounds instead of returning 0")
+	flag.StringVar(&config.DuplicatePolicy, "duplicates", "overwrite", "Policy for inserts at an existing timestamp: overwrite, keep-first, accumulate or reject")
+	flag.StringVar(&config.DataDir, "data-dir", "", "Directory for persistent named series; empty keeps them in memory")
+	flag.StringVar(&config.Fsync, "fsync", "interval", "When to sync the write-ahead log: always, interval or never")
+	flag.DurationVar(&config.FsyncInterval, "fsync-interval", time.Second, "How often to sync the write-ahead log under the interval policy")
+	flag.IntVar(&config.CompactAfter, "compact-after", 100000, "Log records per series before writing a snapshot and dropping old segments")
+	flag.DurationVar(&config.LogIdleTimeout, "log-idle-timeout", time.Minute, "How long the log of a persistent series stays open without writes; 0 keeps logs open")
+	flag.IntVar(&config.MaxSeries, "max-series", 10000, "Maximum number of named series; 0 is unlimited")
+	flag.IntVar(&config.SessionLimit, "session-limit", 0, "Maximum points in a connection's private series; 0 is unlimited")
+	flag.StringVar(&config.SessionLimitPolicy, "session-limit-policy", "reject", "What an insert past the session limit does: reject, evict-oldest or disconnect")
+	flag.Int64Var(&config.MemoryBudget, "memory-budget", 0, "Estimated bytes all series may hold together; 0 is unlimited")
+	flag.StringVar(&config.MemoryBudgetPolicy, "memory-budget-policy", "reject", "What an insert past the memory budget does: reject, evict-oldest or disconnect")
+	flag.DurationVar(&config.FlushDelay, "flush-delay", time.Millisecond, "Longest time a reply waits to be coalesced with later replies to pipelined frames")
+	flag.DurationVar(&config.MinPushInterval, "min-push-interval", 100*time.Millisecond, "Shortest time between two pushes to a subscriber")
+	flag.StringVar(&config.ProtocolErrors, "protocol-errors", "disconnect", "What a bad frame leads to: disconnect, report (error frame, then disconnect) or skip (error frame, then carry on)")
+	flag.Int64Var(&config.Retention, "retention", 0, "Timestamp units a connection's private series keeps behind its newest point; 0 keeps everything")
+	flag.DurationVar(&config.RetentionInterval, "retention-interval", time.Second, "How often points past the retention window are dropped")
+	flag.StringVar(&config.RetentionQueries, "retention-queries", "partial", "How queries past the retention horizon are answered: partial or error")
 	flag.Parse()
 }
 
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Aggregate queries use the same 9-byte frame as QueryOperation: the opcode
+// followed by minTime and maxTime as big-endian int32. Each opcode has a
+// fixed reply width, given for protocol version 1; version 2 widens prices
+// to int64 and sums to 128 bits. An empty range answers 0.
+const (
+	MinOperation    byte = 'L' // lowest price, 4-byte int32
+	MaxOperation    byte = 'H' // highest price, 4-byte int32
+	CountOperation  byte = 'C' // number of prices, 8-byte int64
+	SumOperation    byte = 'S' // sum of prices, 8-byte int64
+	MedianOperation byte = 'D' // 50th percentile, 4-byte int32
+
+	// PercentileOperation+p asks for the p-th percentile, for p from 0 to
+	// 100, as a price. Percentiles use the nearest-rank method, so
+	// they are always one of the stored prices.
+	PercentileOperation byte = 0x80
+	MaxPercentile       byte = 100
+)
+
+// isAggregateOperation reports whether op is one of the aggregate opcodes.
+func isAggregateOperation(op byte) bool {
+	switch op {
+	case MinOperation, MaxOperation, CountOperation, SumOperation, MedianOperation:
+		return true
+	}
+	return op >= PercentileOperation && op <= PercentileOperation+MaxPercentile
+}
+
+func (s *PriceServer) processAggregate(w io.Writer, req request, sess *session) error {
+	minTime, maxTime := s.queryRange(req)
+	var reply []byte
+	sess.current.read(func(prices *priceIndex) {
+		reply = aggregate(sess.proto, req.op, prices, minTime, maxTime)
+	})
+
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// aggregate computes the reply to an aggregate opcode.
+func aggregate(proto protocol, op byte, prices *priceIndex, minTime, maxTime int64) []byte {
+	switch op {
+	case CountOperation:
+		count, _ := prices.Aggregate(minTime, maxTime)
+		return binary.BigEndian.AppendUint64(nil, uint64(count))
+	case SumOperation:
+		_, sum := prices.Aggregate(minTime, maxTime)
+		return proto.appendSum(nil, sum)
+	case MinOperation:
+		return proto.appendValue(nil, rangeExtreme(prices, minTime, maxTime, false))
+	case MaxOperation:
+		return proto.appendValue(nil, rangeExtreme(prices, minTime, maxTime, true))
+	case MedianOperation:
+		return proto.appendValue(nil, rangePercentile(prices, minTime, maxTime, 50))
+	default:
+		p := int(op - PercentileOperation)
+		return proto.appendValue(nil, rangePercentile(prices, minTime, maxTime, p))
+	}
+}
+
+// rangeExtreme returns the lowest, or highest if highest is set, price in
+// the range.
+func rangeExtreme(prices *priceIndex, minTime, maxTime int64, highest bool) int64 {
+	var result int64
+	first := true
+	prices.Ascend(minTime, maxTime, func(_, price int64) bool {
+		if first || (highest && price > result) || (!highest && price < result) {
+			result = price
+			first = false
+		}
+		return true
+	})
+	return result
+}
+
+// rangePercentile returns the p-th percentile of the prices in the range
+// using the nearest-rank method: the smallest price such that at least p% of
+// the prices are less than or equal to it. The 0th percentile is the lowest
+// price.
+func rangePercentile(prices *priceIndex, minTime, maxTime int64, p int) int64 {
+	count, _ := prices.Aggregate(minTime, maxTime)
+	if count == 0 {
+		return 0
+	}
+
+	values := make([]int64, 0, count)
+	prices.Ascend(minTime, maxTime, func(_, price int64) bool {
+		values = append(values, price)
+		return true
+	})
+	slices.Sort(values)
+
+	// rank = ceil(p/100 * n), counted from 1
+	rank := (int64(p)*count + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// TWAPOperation asks for the time-weighted average price over
+// [minTime, maxTime], in the layout of a query. Each price is in effect from
+// its timestamp until the next one, or until maxTime for the last, and is
+// weighted by how long it is in effect within the range. The price in effect
+// at minTime is the latest one before it, if any; otherwise the average
+// starts at the first price in the range. Of several samples at one
+// timestamp the last inserted is the one in effect. A range whose prices are
+// in effect for no time at all, such as a range of one timestamp, averages
+// the price in effect at maxTime. An empty range answers 0.
+//
+// MovingAverageOperation asks for the trailing moving average at every
+// timestamp in [minTime, maxTime] that has a price. Its frame is 13 bytes:
+// the opcode followed by minTime, maxTime and the window as big-endian
+// int32. The average at timestamp t is the mean of the prices with
+// timestamps in [t-window+1, t]. The reply is a big-endian uint32 record
+// count followed by one record per timestamp: the timestamp as a big-endian
+// int32 and the average as a big-endian int64.
+//
+// Both averages are fixed-point numbers in units of 1/AverageScale of a
+// price, truncated towards zero. In protocol version 2 the timestamps are
+// int64 and the averages 128 bits.
+const (
+	TWAPOperation            byte = 'T'
+	MovingAverageOperation   byte = 'W'
+	MovingAverageMessageSize int  = 13
+
+	AverageScale = 1000
+
+	// MaxMovingAverages bounds the number of records in one reply.
+	MaxMovingAverages = 1 << 16
+)
+
+var ErrBadMovingAverageQuery = errors.New("invalid moving average query")
+
+// twap returns the time-weighted average of the prices over
+// [minTime, maxTime], scaled by AverageScale.
+func twap(prices *priceIndex, minTime, maxTime int64) int128 {
+	if minTime > maxTime {
+		return int128{}
+	}
+
+	var weighted int128
+	var span uint64
+	var current, since int64
+	inEffect := false
+	if minTime > math.MinInt64 {
+		if _, price, ok := prices.Floor(minTime - 1); ok {
+			current, since, inEffect = price, minTime, true
+		}
+	}
+
+	// Durations are unsigned, as the whole int64 range does not fit in an
+	// int64
+	prices.Ascend(minTime, maxTime, func(timestamp, price int64) bool {
+		if inEffect {
+			d := uint64(timestamp) - uint64(since)
+			weighted = weighted.add(mulInt64(current, d))
+			span += d
+		}
+		current, since, inEffect = price, timestamp, true
+		return true
+	})
+	if !inEffect {
+		return int128{}
+	}
+	d := uint64(maxTime) - uint64(since)
+	weighted = weighted.add(mulInt64(current, d))
+	span += d
+
+	if span == 0 {
+		return mulInt64(current, AverageScale)
+	}
+	return weighted.scaledQuo(span, AverageScale)
+}
+
+type movingAverage struct {
+	timestamp int64
+	average   int128
+}
+
+// movingAverages returns the trailing moving average over window timestamps
+// at every timestamp in [minTime, maxTime] that has a price, scaled by
+// AverageScale.
+func movingAverages(prices *priceIndex, minTime, maxTime, window int64) ([]movingAverage, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("%w: window %d must be positive", ErrBadMovingAverageQuery, window)
+	}
+
+	var averages []movingAverage
+	var err error
+	prices.Ascend(minTime, maxTime, func(timestamp, _ int64) bool {
+		if n := len(averages); n > 0 && averages[n-1].timestamp == timestamp {
+			return true
+		}
+		if len(averages) == MaxMovingAverages {
+			err = fmt.Errorf("%w: more than %d timestamps", ErrBadMovingAverageQuery, MaxMovingAverages)
+			return false
+		}
+		averages = append(averages, movingAverage{timestamp: timestamp})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range averages {
+		t := averages[i].timestamp
+		start := int64(math.MinInt64)
+		if t >= math.MinInt64+window-1 {
+			start = t - window + 1
+		}
+		count, sum := prices.Aggregate(start, t)
+		averages[i].average = sum.scaledQuo(uint64(count), AverageScale)
+	}
+	return averages, nil
+}
+
+func (s *PriceServer) processTWAP(w io.Writer, req request, sess *session) error {
+	minTime, maxTime := s.queryRange(req)
+
+	var average int128
+	sess.current.read(func(prices *priceIndex) {
+		average = twap(prices, minTime, maxTime)
+	})
+
+	if _, err := w.Write(sess.proto.appendSum(nil, average)); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+func (s *PriceServer) processMovingAverages(w io.Writer, req request, sess *session) error {
+	minTime, maxTime := s.queryRange(req)
+
+	var averages []movingAverage
+	var err error
+	sess.current.read(func(prices *priceIndex) {
+		averages, err = movingAverages(prices, minTime, maxTime, req.args[2])
+	})
+	if err != nil {
+		return err
+	}
+
+	proto := sess.proto
+	reply := binary.BigEndian.AppendUint32(nil, uint32(len(averages)))
+	for _, a := range averages {
+		reply = proto.appendValue(reply, a.timestamp)
+		reply = proto.appendSum(reply, a.average)
+	}
+
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
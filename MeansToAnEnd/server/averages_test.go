@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestTWAP(t *testing.T) {
+	prices := newPriceIndex()
+	prices.Insert(0, 100)
+	prices.Insert(10, 200)
+	prices.Insert(40, 50)
+
+	for _, c := range []struct {
+		minTime, maxTime int64
+		want             int64
+	}{
+		// 100 for 10, 200 for 30, 50 for 10
+		{0, 50, (100*10 + 200*30 + 50*10) * AverageScale / 50},
+		// The price in effect at minTime comes from before the range
+		{5, 15, (100*5 + 200*5) * AverageScale / 10},
+		// Before the first price only the time after it counts
+		{-100, 20, (100*10 + 200*10) * AverageScale / 20},
+		// A single instant averages the price in effect
+		{20, 20, 200 * AverageScale},
+		{-10, -1, 0},
+		{50, 0, 0},
+	} {
+		if got := twap(prices, c.minTime, c.maxTime); got != int128From(c.want) {
+			t.Errorf("twap(%d, %d) = %v, want %d", c.minTime, c.maxTime, got, c.want)
+		}
+	}
+
+	// Five thirds are truncated, not rounded
+	prices = newPriceIndex()
+	prices.Insert(0, 1)
+	prices.Insert(1, 2)
+	if got := twap(prices, 0, 3); got != int128From(1666) {
+		t.Errorf("Expected 1666 thousandths, got %v", got)
+	}
+}
+
+func TestTWAPWholeRange(t *testing.T) {
+	prices := newPriceIndex()
+	prices.Insert(math.MinInt64, math.MaxInt64)
+	prices.Insert(0, math.MaxInt64)
+	want := mulInt64(math.MaxInt64, AverageScale)
+	if got := twap(prices, math.MinInt64, math.MaxInt64); got != want {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestMovingAverages(t *testing.T) {
+	prices := newPriceIndex()
+	for _, p := range [][2]int64{{1, 10}, {2, 20}, {2, 40}, {5, 30}, {9, -3}} {
+		prices.Add(p[0], p[1])
+	}
+
+	averages, err := movingAverages(prices, 2, 9, 3)
+	if err != nil {
+		t.Fatalf("movingAverages failed: %v", err)
+	}
+	want := []movingAverage{
+		{2, int128From(70 * AverageScale / 3)},
+		{5, int128From(30 * AverageScale)},
+		{9, int128From(-3 * AverageScale)},
+	}
+	if len(averages) != len(want) {
+		t.Fatalf("Expected %d averages, got %v", len(want), averages)
+	}
+	for i := range want {
+		if averages[i] != want[i] {
+			t.Errorf("Average %d: expected %v, got %v", i, want[i], averages[i])
+		}
+	}
+
+	if _, err := movingAverages(prices, 0, 10, 0); !errors.Is(err, ErrBadMovingAverageQuery) {
+		t.Errorf("Expected ErrBadMovingAverageQuery for zero window, got %v", err)
+	}
+	if averages, err := movingAverages(prices, math.MinInt64, math.MinInt64, math.MaxInt64); err != nil || len(averages) != 0 {
+		t.Errorf("Expected no averages, got %v, %v", averages, err)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// ioBufferSize is the size of each connection's read and write buffers.
+const ioBufferSize = 64 << 10
+
+// frameBuffered reports whether r holds a complete frame, so that reading it
+// cannot block.
+func frameBuffered(r *bufio.Reader) bool {
+	if r.Buffered() < MessageSize {
+		return false
+	}
+	header, _ := r.Peek(MessageSize)
+	size, err := frameSize(header)
+	// A bad frame fails without blocking too
+	return err != nil || r.Buffered() >= size
+}
+
+// replyWriter buffers the replies to a connection. The connection loop
+// flushes it whenever no complete frame is waiting to be read; a client that
+// pipelines without pause still gets its replies within delay of the first
+// unflushed one. A mutex guards the buffer, as the delayed flush runs on a
+// timer goroutine.
+type replyWriter struct {
+	mutex sync.Mutex
+	w     *bufio.Writer
+	delay time.Duration
+	timer *time.Timer
+	err   error // from a delayed flush, returned by the next call
+}
+
+func newReplyWriter(w io.Writer, delay time.Duration) *replyWriter {
+	return &replyWriter{w: bufio.NewWriterSize(w, ioBufferSize), delay: delay}
+}
+
+func (rw *replyWriter) Write(p []byte) (int, error) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	n, err := rw.w.Write(p)
+	if err == nil && rw.delay > 0 && rw.timer == nil && rw.w.Buffered() > 0 {
+		rw.timer = time.AfterFunc(rw.delay, func() {
+			rw.Flush()
+		})
+	}
+	return n, err
+}
+
+// Flush writes out any buffered replies.
+func (rw *replyWriter) Flush() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.timer != nil {
+		rw.timer.Stop()
+		rw.timer = nil
+	}
+	if rw.err == nil {
+		rw.err = rw.w.Flush()
+	}
+	return rw.err
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFrameBuffered(t *testing.T) {
+	candle := append(message(CandleOperation, 0, 100), 0, 0, 0, 10)
+	cases := []struct {
+		name  string
+		input []byte
+		want  bool
+	}{
+		{"empty", nil, false},
+		{"partial header", message(QueryOperation, 1, 2)[:5], false},
+		{"query", message(QueryOperation, 1, 2), true},
+		{"partial candle", candle[:10], false},
+		{"candle", candle, true},
+		{"oversized attach", []byte{AttachOperation, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, true},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader(c.input))
+		r.Peek(len(c.input))
+		if got := frameBuffered(r); got != c.want {
+			t.Errorf("%s: frameBuffered = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that a timer goroutine can write to.
+type lockedBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Len()
+}
+
+func TestReplyWriterFlushesAfterDelay(t *testing.T) {
+	var out lockedBuffer
+	w := newReplyWriter(&out, 20*time.Millisecond)
+	w.Write([]byte{1, 2, 3, 4})
+	w.Write([]byte{5, 6, 7, 8})
+	if out.Len() != 0 {
+		t.Fatalf("Expected replies to be held back, got %d bytes", out.Len())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for out.Len() != 8 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if out.Len() != 8 {
+		t.Errorf("Expected 8 bytes after the delay, got %d", out.Len())
+	}
+}
+
+func TestReplyWriterWithoutDelayWaitsForFlush(t *testing.T) {
+	var out lockedBuffer
+	w := newReplyWriter(&out, 0)
+	w.Write([]byte{1, 2, 3, 4})
+	time.Sleep(10 * time.Millisecond)
+	if out.Len() != 0 {
+		t.Fatalf("Expected no write before Flush, got %d bytes", out.Len())
+	}
+	if err := w.Flush(); err != nil || out.Len() != 4 {
+		t.Errorf("Flush wrote %d bytes: %v", out.Len(), err)
+	}
+}
+
+const pipelineFrames = 1 << 20
+
+// benchClient connects to a server handling a single connection over
+// loopback TCP.
+func benchClient(b *testing.B, delay time.Duration) net.Conn {
+	b.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &PriceServer{listener: listener, store: newSeriesStore(nil), flushDelay: delay}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		s.handleConnection(conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		conn.Close()
+		listener.Close()
+	})
+	return conn
+}
+
+// pipeline writes frames to conn while reading replyBytes of replies.
+func pipeline(b *testing.B, conn net.Conn, frames func(w *bufio.Writer), replyBytes int64) {
+	b.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, conn, replyBytes)
+		done <- err
+	}()
+
+	w := bufio.NewWriterSize(conn, ioBufferSize)
+	frames(w)
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkPipelinedInserts(b *testing.B, delay time.Duration) {
+	conn := benchClient(b, delay)
+	b.SetBytes(pipelineFrames * int64(MessageSize))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		// The trailing query is answered once every insert is stored
+		pipeline(b, conn, func(w *bufio.Writer) {
+			for j := int32(0); j < pipelineFrames; j++ {
+				w.Write(message(InsertOperation, int32(i)*pipelineFrames+j, j))
+			}
+			w.Write(message(QueryOperation, 0, 0))
+		}, 4)
+	}
+}
+
+func benchmarkPipelinedQueries(b *testing.B, delay time.Duration) {
+	conn := benchClient(b, delay)
+	pipeline(b, conn, func(w *bufio.Writer) {
+		for j := int32(0); j < 1000; j++ {
+			w.Write(message(InsertOperation, j, j))
+		}
+	}, 0)
+	b.SetBytes(pipelineFrames * int64(MessageSize))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pipeline(b, conn, func(w *bufio.Writer) {
+			for j := int32(0); j < pipelineFrames; j++ {
+				w.Write(message(QueryOperation, j%1000, j%1000+100))
+			}
+		}, pipelineFrames*4)
+	}
+}
+
+func BenchmarkPipelinedInserts(b *testing.B) {
+	b.Run("flush-delay=0", func(b *testing.B) { benchmarkPipelinedInserts(b, 0) })
+	b.Run("flush-delay=1ms", func(b *testing.B) { benchmarkPipelinedInserts(b, time.Millisecond) })
+}
+
+func BenchmarkPipelinedQueries(b *testing.B) {
+	b.Run("flush-delay=0", func(b *testing.B) { benchmarkPipelinedQueries(b, 0) })
+	b.Run("flush-delay=1ms", func(b *testing.B) { benchmarkPipelinedQueries(b, time.Millisecond) })
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CandleOperation asks for OHLC candles. Its frame is 13 bytes: the opcode
+// followed by minTime, maxTime and the bucket width as big-endian int32.
+//
+// The reply is a big-endian uint32 record count followed by one record per
+// bucket, starting at minTime. Each record is six big-endian 4-byte fields:
+// bucket start, open, high, low and close as int32 and the number of prices
+// as uint32. Empty buckets have a count of 0 and zero prices. In protocol
+// version 2 the bucket start and prices are int64, making records
+// CandleRecordSizeV2 bytes.
+const (
+	CandleOperation    byte = 'K'
+	CandleMessageSize  int  = 13
+	CandleRecordSize   int  = 24
+	CandleRecordSizeV2 int  = 44
+
+	// MaxCandles bounds the number of buckets in one reply.
+	MaxCandles = 1 << 16
+)
+
+var ErrBadCandleQuery = errors.New("invalid candle query")
+
+type candle struct {
+	start                  int64
+	open, high, low, close int64
+	count                  uint32
+}
+
+// buildCandles groups the prices in [minTime, maxTime] into buckets of width
+// timestamps. Open and close are the prices with the earliest and latest
+// timestamps in a bucket.
+func buildCandles(prices *priceIndex, minTime, maxTime, width int64) ([]candle, error) {
+	if width <= 0 {
+		return nil, fmt.Errorf("%w: width %d must be positive", ErrBadCandleQuery, width)
+	}
+	if minTime > maxTime {
+		return nil, nil
+	}
+
+	// Offsets from minTime are unsigned, as the whole int64 range does not
+	// fit in an int64. The limit is checked before counting the first
+	// bucket, as the whole range in width 1 would wrap to zero buckets.
+	last := (uint64(maxTime) - uint64(minTime)) / uint64(width)
+	if last >= MaxCandles {
+		return nil, fmt.Errorf("%w: more than %d buckets", ErrBadCandleQuery, MaxCandles)
+	}
+	buckets := last + 1
+
+	candles := make([]candle, buckets)
+	for i := range candles {
+		candles[i].start = int64(uint64(minTime) + uint64(i)*uint64(width))
+	}
+
+	prices.Ascend(minTime, maxTime, func(timestamp, price int64) bool {
+		c := &candles[(uint64(timestamp)-uint64(minTime))/uint64(width)]
+		if c.count == 0 {
+			c.open, c.high, c.low = price, price, price
+		}
+		c.high = max(c.high, price)
+		c.low = min(c.low, price)
+		c.close = price
+		c.count++
+		return true
+	})
+	return candles, nil
+}
+
+func (s *PriceServer) processCandles(w io.Writer, req request, sess *session) error {
+	minTime, maxTime := s.queryRange(req)
+	width := req.args[2]
+
+	var candles []candle
+	var err error
+	sess.current.read(func(prices *priceIndex) {
+		candles, err = buildCandles(prices, minTime, maxTime, width)
+	})
+	if err != nil {
+		return err
+	}
+
+	proto := sess.proto
+	reply := make([]byte, 0, 4+len(candles)*CandleRecordSizeV2)
+	reply = binary.BigEndian.AppendUint32(reply, uint32(len(candles)))
+	for _, c := range candles {
+		reply = proto.appendValue(reply, c.start)
+		reply = proto.appendValue(reply, c.open)
+		reply = proto.appendValue(reply, c.high)
+		reply = proto.appendValue(reply, c.low)
+		reply = proto.appendValue(reply, c.close)
+		reply = binary.BigEndian.AppendUint32(reply, c.count)
+	}
+
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
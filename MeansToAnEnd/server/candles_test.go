@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestBuildCandlesLimits(t *testing.T) {
+	prices := newPriceIndex()
+	prices.Insert(math.MaxInt32, 5)
+	prices.Insert(math.MinInt32, -5)
+
+	if _, err := buildCandles(prices, 0, 10, -1); !errors.Is(err, ErrBadCandleQuery) {
+		t.Errorf("Expected ErrBadCandleQuery for negative width, got %v", err)
+	}
+	if _, err := buildCandles(prices, math.MinInt32, math.MaxInt32, 1000); !errors.Is(err, ErrBadCandleQuery) {
+		t.Errorf("Expected ErrBadCandleQuery for too many buckets, got %v", err)
+	}
+	// The bucket count of the whole int64 range in width 1 wraps to zero
+	if _, err := buildCandles(prices, math.MinInt64, math.MaxInt64, 1); !errors.Is(err, ErrBadCandleQuery) {
+		t.Errorf("Expected ErrBadCandleQuery for the whole int64 range in width 1, got %v", err)
+	}
+	if _, err := buildCandles(prices, 0, MaxCandles, 1); !errors.Is(err, ErrBadCandleQuery) {
+		t.Errorf("Expected ErrBadCandleQuery for one bucket too many, got %v", err)
+	}
+	if candles, err := buildCandles(prices, 1, MaxCandles, 1); err != nil || len(candles) != MaxCandles {
+		t.Errorf("Expected %d buckets, got %d: %v", MaxCandles, len(candles), err)
+	}
+	if candles, err := buildCandles(prices, 10, 0, 1); err != nil || len(candles) != 0 {
+		t.Errorf("Expected no candles for reversed range, got %v, %v", candles, err)
+	}
+
+	// Buckets spanning the whole int32 range must not overflow
+	candles, err := buildCandles(prices, math.MinInt32, math.MaxInt32, math.MaxInt32)
+	if err != nil {
+		t.Fatalf("buildCandles returned error: %v", err)
+	}
+	if len(candles) != 3 {
+		t.Fatalf("Expected 3 buckets, got %d", len(candles))
+	}
+	if candles[0].open != -5 || candles[0].count != 1 {
+		t.Errorf("Unexpected first bucket %+v", candles[0])
+	}
+	if candles[2].start != math.MaxInt32-1 || candles[2].close != 5 || candles[2].count != 1 {
+		t.Errorf("Unexpected last bucket %+v", candles[2])
+	}
+
+	// And so must buckets spanning the whole int64 range
+	candles, err = buildCandles(prices, math.MinInt64, math.MaxInt64, math.MaxInt64)
+	if err != nil || len(candles) != 3 || candles[1].start != -1 || candles[1].count != 1 {
+		t.Errorf("Unexpected int64-wide buckets %+v: %v", candles, err)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func message(op byte, a, b int32) []byte {
+	msg := []byte{op, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:5], uint32(a))
+	binary.BigEndian.PutUint32(msg[5:9], uint32(b))
+	return msg
+}
+
+func insert(t *testing.T, s *PriceServer, sess *session, timestamp, price int32) error {
+	t.Helper()
+	return s.processMessage(nil, decodeV1(message(InsertOperation, timestamp, price)), sess)
+}
+
+// query runs a query directly against processMessage and returns the reply.
+func query(t *testing.T, s *PriceServer, sess *session, minTime, maxTime int32) int32 {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	reply := make([]byte, 4)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Read(reply)
+		done <- err
+	}()
+	if err := s.processMessage(conn, decodeV1(message(QueryOperation, minTime, maxTime)), sess); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return int32(binary.BigEndian.Uint32(reply))
+}
+
+// queryReversed inserts a price and queries it with the bounds reversed.
+func queryReversed(t *testing.T, s *PriceServer) int32 {
+	t.Helper()
+	sess := newSession()
+	if err := insert(t, s, sess, 2000, 400); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	return query(t, s, sess, 3000, 1000)
+}
+
+func TestReversedRangeFollowsSpecByDefault(t *testing.T) {
+	if got := queryReversed(t, &PriceServer{}); got != 0 {
+		t.Errorf("Expected 0 for reversed range, got %d", got)
+	}
+}
+
+func TestReversedRangeSwapCompatibility(t *testing.T) {
+	if got := queryReversed(t, &PriceServer{swapReversedRange: true}); got != 400 {
+		t.Errorf("Expected 400 with swap compatibility enabled, got %d", got)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DuplicatePolicy decides what an insert does when the session already has a
+// price at the same timestamp. The protocol leaves this undefined.
+type DuplicatePolicy int
+
+const (
+	// DuplicateOverwrite replaces the stored price with the new one.
+	DuplicateOverwrite DuplicatePolicy = iota
+	// DuplicateKeepFirst ignores the new price.
+	DuplicateKeepFirst
+	// DuplicateAccumulate keeps both prices as separate samples, so each
+	// counts towards the mean.
+	DuplicateAccumulate
+	// DuplicateReject treats the insert as a protocol error and disconnects.
+	DuplicateReject
+)
+
+var ErrDuplicateTimestamp = errors.New("duplicate timestamp")
+
+var duplicatePolicyNames = map[DuplicatePolicy]string{
+	DuplicateOverwrite:  "overwrite",
+	DuplicateKeepFirst:  "keep-first",
+	DuplicateAccumulate: "accumulate",
+	DuplicateReject:     "reject",
+}
+
+func (p DuplicatePolicy) String() string {
+	if name, ok := duplicatePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("DuplicatePolicy(%d)", int(p))
+}
+
+// ParseDuplicatePolicy accepts the names printed by String. An empty name
+// selects DuplicateOverwrite.
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	if name == "" {
+		return DuplicateOverwrite, nil
+	}
+	for p, n := range duplicatePolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown duplicate policy %q (want overwrite, keep-first, accumulate or reject)", name)
+}
+
+// insert stores a price according to the policy.
+func (p DuplicatePolicy) insert(prices *priceIndex, timestamp, price int64) error {
+	kind, err := p.resolve(prices, timestamp)
+	if err != nil {
+		return err
+	}
+	kind.apply(prices, timestamp, price)
+	return nil
+}
+
+// resolve decides how an insert at timestamp changes prices without changing
+// them, so that the change can be logged before it is applied.
+func (p DuplicatePolicy) resolve(prices *priceIndex, timestamp int64) (recordKind, error) {
+	switch p {
+	case DuplicateAccumulate:
+		return recordAdd, nil
+	case DuplicateOverwrite:
+		return recordSet, nil
+	}
+
+	if _, exists := prices.Get(timestamp); exists {
+		if p == DuplicateReject {
+			return recordNone, fmt.Errorf("%w %d", ErrDuplicateTimestamp, timestamp)
+		}
+		return recordNone, nil
+	}
+	return recordAdd, nil
+}
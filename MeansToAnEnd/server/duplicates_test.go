@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// insertDuplicates inserts 100 then 300 at the same timestamp and returns
+// the error from the second insert.
+func insertDuplicates(t *testing.T, s *PriceServer, sess *session) error {
+	t.Helper()
+	if err := insert(t, s, sess, 1000, 100); err != nil {
+		t.Fatalf("First insert failed: %v", err)
+	}
+	if err := insert(t, s, sess, 2000, 600); err != nil {
+		t.Fatalf("Insert at another timestamp failed: %v", err)
+	}
+	return insert(t, s, sess, 1000, 300)
+}
+
+func TestDuplicateOverwrite(t *testing.T) {
+	s := &PriceServer{duplicates: DuplicateOverwrite}
+	sess := newSession()
+	if err := insertDuplicates(t, s, sess); err != nil {
+		t.Fatalf("Duplicate insert failed: %v", err)
+	}
+	if got := query(t, s, sess, 1000, 1000); got != 300 {
+		t.Errorf("Expected 300 after overwrite, got %d", got)
+	}
+	if got := query(t, s, sess, 0, 5000); got != 450 {
+		t.Errorf("Expected mean 450, got %d", got)
+	}
+}
+
+func TestDuplicateKeepFirst(t *testing.T) {
+	s := &PriceServer{duplicates: DuplicateKeepFirst}
+	sess := newSession()
+	if err := insertDuplicates(t, s, sess); err != nil {
+		t.Fatalf("Duplicate insert failed: %v", err)
+	}
+	if got := query(t, s, sess, 1000, 1000); got != 100 {
+		t.Errorf("Expected first price 100 to be kept, got %d", got)
+	}
+	if got := query(t, s, sess, 0, 5000); got != 350 {
+		t.Errorf("Expected mean 350, got %d", got)
+	}
+}
+
+func TestDuplicateAccumulate(t *testing.T) {
+	s := &PriceServer{duplicates: DuplicateAccumulate}
+	sess := newSession()
+	if err := insertDuplicates(t, s, sess); err != nil {
+		t.Fatalf("Duplicate insert failed: %v", err)
+	}
+	if sess.current.prices.Len() != 3 {
+		t.Errorf("Expected 3 samples, got %d", sess.current.prices.Len())
+	}
+	if got := query(t, s, sess, 1000, 1000); got != 200 {
+		t.Errorf("Expected mean of both samples 200, got %d", got)
+	}
+	if got := query(t, s, sess, 0, 5000); got != 333 {
+		t.Errorf("Expected mean 333, got %d", got)
+	}
+}
+
+func TestDuplicateReject(t *testing.T) {
+	s := &PriceServer{duplicates: DuplicateReject}
+	sess := newSession()
+	if err := insertDuplicates(t, s, sess); !errors.Is(err, ErrDuplicateTimestamp) {
+		t.Fatalf("Expected ErrDuplicateTimestamp, got %v", err)
+	}
+	if got := query(t, s, sess, 1000, 1000); got != 100 {
+		t.Errorf("Expected rejected insert to leave 100, got %d", got)
+	}
+
+	// On a connection the rejected insert closes it
+	s = &PriceServer{store: newSeriesStore(nil), duplicates: DuplicateReject}
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.wg.Add(1)
+	go s.handleConnection(conn)
+	go func() {
+		client.Write(message(InsertOperation, 1000, 100))
+		client.Write(message(InsertOperation, 1000, 300))
+	}()
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %d bytes: %v", n, err)
+	}
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	for p, name := range duplicatePolicyNames {
+		got, err := ParseDuplicatePolicy(name)
+		if err != nil || got != p {
+			t.Errorf("ParseDuplicatePolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseDuplicatePolicy("sometimes"); err == nil {
+		t.Errorf("Expected error for unknown policy")
+	}
+}
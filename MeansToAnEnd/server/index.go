@@ -0,0 +1,265 @@
+package server
+
+import "math/rand/v2"
+
+// priceIndex maps timestamps to prices in timestamp order. It is a treap:
+// a binary search tree on timestamps that is kept balanced by random heap
+// priorities, so inserts take O(log n) and a range scan over k points takes
+// O(log n + k), both expected. Every node also records the count and sum of
+// the prices in its subtree, which answers Aggregate over any range in
+// O(log n).
+//
+// Points are ordered by timestamp and then by insertion sequence, so Add can
+// keep several samples for the same timestamp.
+type priceIndex struct {
+	root    *indexNode
+	size    int
+	seed    uint64
+	nextSeq uint64
+}
+
+type indexNode struct {
+	timestamp   int64
+	seq         uint64
+	price       int64
+	priority    uint64
+	left, right *indexNode
+
+	// Aggregates over this node and its descendants
+	count int64
+	sum   int128
+}
+
+// update recomputes the aggregates of n from its children.
+func (n *indexNode) update() {
+	n.count, n.sum = 1, int128From(n.price)
+	if n.left != nil {
+		n.count += n.left.count
+		n.sum = n.sum.add(n.left.sum)
+	}
+	if n.right != nil {
+		n.count += n.right.count
+		n.sum = n.sum.add(n.right.sum)
+	}
+}
+
+// newPriceIndex seeds each index at random, so that clients cannot predict
+// the priorities and pick insert orders that unbalance the treap. xorshift
+// needs a nonzero seed.
+func newPriceIndex() *priceIndex {
+	return &priceIndex{seed: rand.Uint64() | 1}
+}
+
+// nextPriority is a xorshift generator; treap balance only needs priorities
+// that are independent of the keys, not cryptographic randomness.
+func (ix *priceIndex) nextPriority() uint64 {
+	ix.seed ^= ix.seed << 13
+	ix.seed ^= ix.seed >> 7
+	ix.seed ^= ix.seed << 17
+	return ix.seed
+}
+
+// Len returns the number of stored points.
+func (ix *priceIndex) Len() int {
+	return ix.size
+}
+
+// before reports whether n sorts before the point (timestamp, seq).
+func (n *indexNode) before(timestamp int64, seq uint64) bool {
+	return n.timestamp < timestamp || (n.timestamp == timestamp && n.seq < seq)
+}
+
+// Insert stores price at timestamp, replacing the existing price if there
+// is exactly one. Use Add to keep several samples per timestamp.
+func (ix *priceIndex) Insert(timestamp, price int64) {
+	if old, ok := ix.Get(timestamp); ok {
+		// Overwrite in place and fix up the sums along the search path
+		delta := int128From(price).sub(int128From(old))
+		for n := ix.root; ; {
+			n.sum = n.sum.add(delta)
+			switch {
+			case timestamp < n.timestamp:
+				n = n.left
+			case timestamp > n.timestamp:
+				n = n.right
+			default:
+				n.price = price
+				return
+			}
+		}
+	}
+
+	ix.Add(timestamp, price)
+}
+
+// Add stores price as a new sample at timestamp, after any samples already
+// stored there.
+func (ix *priceIndex) Add(timestamp, price int64) {
+	node := &indexNode{
+		timestamp: timestamp,
+		seq:       ix.nextSeq,
+		price:     price,
+		priority:  ix.nextPriority(),
+		count:     1,
+		sum:       int128From(price),
+	}
+	ix.nextSeq++
+
+	left, right := split(ix.root, timestamp, node.seq)
+	ix.root = merge(merge(left, node), right)
+	ix.size++
+}
+
+// DeleteOldest removes the first point in timestamp order and reports
+// whether there was one.
+func (ix *priceIndex) DeleteOldest() bool {
+	if ix.root == nil {
+		return false
+	}
+	ix.root = deleteFirst(ix.root)
+	ix.size--
+	return true
+}
+
+// DeleteBefore removes the points with timestamps below timestamp and
+// returns how many it removed.
+func (ix *priceIndex) DeleteBefore(timestamp int64) int {
+	old, rest := split(ix.root, timestamp, 0)
+	ix.root = rest
+	if old == nil {
+		return 0
+	}
+	ix.size -= int(old.count)
+	return int(old.count)
+}
+
+func deleteFirst(n *indexNode) *indexNode {
+	if n.left == nil {
+		return n.right
+	}
+	n.left = deleteFirst(n.left)
+	n.update()
+	return n
+}
+
+// Get returns a price stored at timestamp.
+func (ix *priceIndex) Get(timestamp int64) (int64, bool) {
+	for n := ix.root; n != nil; {
+		switch {
+		case timestamp < n.timestamp:
+			n = n.left
+		case timestamp > n.timestamp:
+			n = n.right
+		default:
+			return n.price, true
+		}
+	}
+	return 0, false
+}
+
+// Floor returns the latest point with a timestamp at or below timestamp.
+func (ix *priceIndex) Floor(timestamp int64) (int64, int64, bool) {
+	var found *indexNode
+	for n := ix.root; n != nil; {
+		if n.timestamp <= timestamp {
+			found = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if found == nil {
+		return 0, 0, false
+	}
+	return found.timestamp, found.price, true
+}
+
+// Aggregate returns the number and sum of the prices with
+// minTime <= timestamp <= maxTime.
+func (ix *priceIndex) Aggregate(minTime, maxTime int64) (count int64, sum int128) {
+	if minTime > maxTime {
+		return 0, int128{}
+	}
+	count, sum = ix.below(maxTime, true)
+	lowCount, lowSum := ix.below(minTime, false)
+	return count - lowCount, sum.sub(lowSum)
+}
+
+// below aggregates the prices with timestamps below key, or at or below key
+// if inclusive is set, by walking a single root-to-leaf path.
+func (ix *priceIndex) below(key int64, inclusive bool) (count int64, sum int128) {
+	for n := ix.root; n != nil; {
+		if n.timestamp < key || (inclusive && n.timestamp == key) {
+			count++
+			sum = sum.add(int128From(n.price))
+			if n.left != nil {
+				count += n.left.count
+				sum = sum.add(n.left.sum)
+			}
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return count, sum
+}
+
+// Ascend calls fn for every point with minTime <= timestamp <= maxTime in
+// timestamp order, stopping early if fn returns false.
+func (ix *priceIndex) Ascend(minTime, maxTime int64, fn func(timestamp, price int64) bool) {
+	ascend(ix.root, minTime, maxTime, fn)
+}
+
+func ascend(n *indexNode, minTime, maxTime int64, fn func(timestamp, price int64) bool) bool {
+	if n == nil {
+		return true
+	}
+	// Samples sharing a timestamp can sit on either side of n
+	if n.timestamp >= minTime && !ascend(n.left, minTime, maxTime, fn) {
+		return false
+	}
+	if n.timestamp >= minTime && n.timestamp <= maxTime && !fn(n.timestamp, n.price) {
+		return false
+	}
+	if n.timestamp <= maxTime {
+		return ascend(n.right, minTime, maxTime, fn)
+	}
+	return true
+}
+
+// split divides a treap into the nodes that sort before (timestamp, seq)
+// and the rest.
+func split(n *indexNode, timestamp int64, seq uint64) (*indexNode, *indexNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.before(timestamp, seq) {
+		left, right := split(n.right, timestamp, seq)
+		n.right = left
+		n.update()
+		return n, right
+	}
+	left, right := split(n.left, timestamp, seq)
+	n.left = right
+	n.update()
+	return left, n
+}
+
+// merge joins two treaps where every point in a sorts before every point
+// in b.
+func merge(a, b *indexNode) *indexNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestPriceIndexMatchesMap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ix := newPriceIndex()
+	want := make(map[int64]int64)
+
+	for i := 0; i < 5000; i++ {
+		timestamp := int64(rng.Intn(2000) - 1000)
+		price := int64(rng.Intn(1000) - 500)
+		ix.Insert(timestamp, price)
+		want[timestamp] = price
+	}
+	if ix.Len() != len(want) {
+		t.Fatalf("Expected %d points, got %d", len(want), ix.Len())
+	}
+
+	for i := 0; i < 200; i++ {
+		minTime := int64(rng.Intn(2400) - 1200)
+		maxTime := minTime + int64(rng.Intn(600))
+
+		count := 0
+		prev := minTime - 1
+		ix.Ascend(minTime, maxTime, func(timestamp, price int64) bool {
+			if timestamp <= prev || timestamp > maxTime {
+				t.Fatalf("Timestamp %d out of order or range [%d, %d]", timestamp, minTime, maxTime)
+			}
+			if want[timestamp] != price {
+				t.Fatalf("Timestamp %d: expected price %d, got %d", timestamp, want[timestamp], price)
+			}
+			prev = timestamp
+			count++
+			return true
+		})
+
+		expected := 0
+		for timestamp := range want {
+			if timestamp >= minTime && timestamp <= maxTime {
+				expected++
+			}
+		}
+		if count != expected {
+			t.Errorf("Range [%d, %d]: expected %d points, got %d", minTime, maxTime, expected, count)
+		}
+	}
+}
+
+func TestPriceIndexSeedsDiffer(t *testing.T) {
+	// Equal priorities in every index would let a client plan a degenerate
+	// insert order
+	a, b := newPriceIndex(), newPriceIndex()
+	if a.nextPriority() == b.nextPriority() {
+		t.Errorf("Two indexes drew the same first priority")
+	}
+}
+
+func TestPriceIndexAggregate(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	ix := newPriceIndex()
+	want := make(map[int64]int64)
+
+	for i := 0; i < 5000; i++ {
+		// Out-of-order inserts with plenty of overwrites, and prices large
+		// enough that sums overflow an int64
+		timestamp := int64(rng.Intn(1000) - 500)
+		price := rng.Int63() - 1<<62
+		ix.Insert(timestamp, price)
+		want[timestamp] = price
+
+		if i%50 != 0 {
+			continue
+		}
+		minTime := int64(rng.Intn(1200) - 600)
+		maxTime := minTime + int64(rng.Intn(600)) - 100
+
+		var wantCount int64
+		var wantSum int128
+		for ts, p := range want {
+			if ts >= minTime && ts <= maxTime {
+				wantCount++
+				wantSum = wantSum.add(int128From(p))
+			}
+		}
+		count, sum := ix.Aggregate(minTime, maxTime)
+		if count != wantCount || sum != wantSum {
+			t.Fatalf("Aggregate(%d, %d) = (%d, %d), want (%d, %d)", minTime, maxTime, count, sum, wantCount, wantSum)
+		}
+	}
+}
+
+func TestPriceIndexAddKeepsSamples(t *testing.T) {
+	ix := newPriceIndex()
+	for i := int64(0); i < 50; i++ {
+		ix.Add(i%5, i)
+	}
+	if ix.Len() != 50 {
+		t.Fatalf("Expected 50 samples, got %d", ix.Len())
+	}
+
+	count := 0
+	ix.Ascend(2, 2, func(timestamp, _ int64) bool {
+		if timestamp != 2 {
+			t.Errorf("Unexpected timestamp %d", timestamp)
+		}
+		count++
+		return true
+	})
+	if count != 10 {
+		t.Errorf("Expected 10 samples at timestamp 2, got %d", count)
+	}
+	if n, _ := ix.Aggregate(2, 3); n != 20 {
+		t.Errorf("Expected 20 samples in [2, 3], got %d", n)
+	}
+}
+
+func TestPriceIndexAscendStopsEarly(t *testing.T) {
+	ix := newPriceIndex()
+	for i := int64(0); i < 100; i++ {
+		ix.Insert(i, i)
+	}
+
+	var seen []int64
+	ix.Ascend(10, 90, func(timestamp, _ int64) bool {
+		seen = append(seen, timestamp)
+		return len(seen) < 3
+	})
+	if len(seen) != 3 || seen[0] != 10 || seen[2] != 12 {
+		t.Errorf("Expected [10 11 12], got %v", seen)
+	}
+}
+
+func TestPriceIndexDeleteOldest(t *testing.T) {
+	ix := newPriceIndex()
+	for _, i := range []int64{50, 10, 40, 10, 30} {
+		ix.Add(i, i)
+	}
+
+	for _, next := range []int64{10, 30, 40, 50} {
+		if !ix.DeleteOldest() {
+			t.Fatal("Expected a point to delete")
+		}
+		if count, sum := ix.Aggregate(0, 100); count != int64(ix.Len()) || sum == (int128{}) {
+			t.Errorf("Aggregates out of date: count %d sum %d with %d points", count, sum, ix.Len())
+		}
+		var first int64
+		ix.Ascend(0, 100, func(timestamp, _ int64) bool {
+			first = timestamp
+			return false
+		})
+		if first != next {
+			t.Errorf("Expected oldest point at %d, got %d", next, first)
+		}
+	}
+	ix.DeleteOldest()
+	if ix.Len() != 0 || ix.DeleteOldest() {
+		t.Errorf("Expected an empty index, got %d points", ix.Len())
+	}
+}
+
+func TestPriceIndexDeleteBefore(t *testing.T) {
+	ix := newPriceIndex()
+	for i := int64(0); i < 100; i++ {
+		ix.Add(i%50, i)
+	}
+
+	if n := ix.DeleteBefore(20); n != 40 || ix.Len() != 60 {
+		t.Fatalf("Expected 40 points deleted leaving 60, got %d leaving %d", n, ix.Len())
+	}
+	if count, _ := ix.Aggregate(math.MinInt64, math.MaxInt64); count != 60 {
+		t.Errorf("Aggregates out of date: count %d", count)
+	}
+	if _, _, ok := ix.Floor(19); ok {
+		t.Error("Expected no points below 20")
+	}
+	if n := ix.DeleteBefore(20); n != 0 {
+		t.Errorf("Expected nothing more to delete, got %d", n)
+	}
+}
+
+const benchPoints = 1 << 20
+
+// mapAverage is the previous O(n) query over a map, kept for comparison.
+func mapAverage(priceMap map[int64]int64, minTime, maxTime int64) int64 {
+	var total, count int64
+	for timestamp, price := range priceMap {
+		if timestamp >= minTime && timestamp <= maxTime {
+			total += price
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return total / count
+}
+
+func BenchmarkInsertIndexInOrder(b *testing.B) {
+	ix := newPriceIndex()
+	for i := 0; i < b.N; i++ {
+		ix.Insert(int64(i), int64(i))
+	}
+}
+
+func BenchmarkInsertIndexRandom(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	ix := newPriceIndex()
+	for i := 0; i < b.N; i++ {
+		ix.Insert(rng.Int63(), int64(i))
+	}
+}
+
+func BenchmarkInsertMap(b *testing.B) {
+	priceMap := make(map[int64]int64)
+	for i := 0; i < b.N; i++ {
+		priceMap[int64(i)] = int64(i)
+	}
+}
+
+// Narrow queries over a large session are where the map scan hurts most.
+func BenchmarkQueryIndexNarrow(b *testing.B) {
+	ix := newPriceIndex()
+	for i := 0; i < benchPoints; i++ {
+		ix.Insert(int64(i), int64(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		minTime := int64(i % (benchPoints - 100))
+		calculateAverage(ix, minTime, minTime+100)
+	}
+}
+
+func BenchmarkQueryMapScanNarrow(b *testing.B) {
+	priceMap := make(map[int64]int64, benchPoints)
+	for i := 0; i < benchPoints; i++ {
+		priceMap[int64(i)] = int64(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		minTime := int64(i % (benchPoints - 100))
+		mapAverage(priceMap, minTime, minTime+100)
+	}
+}
+
+func BenchmarkQueryIndexWide(b *testing.B) {
+	ix := newPriceIndex()
+	for i := 0; i < benchPoints; i++ {
+		ix.Insert(int64(i), int64(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		calculateAverage(ix, 0, benchPoints)
+	}
+}
+
+func BenchmarkQueryMapScanWide(b *testing.B) {
+	priceMap := make(map[int64]int64, benchPoints)
+	for i := 0; i < benchPoints; i++ {
+		priceMap[int64(i)] = int64(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mapAverage(priceMap, 0, benchPoints)
+	}
+}
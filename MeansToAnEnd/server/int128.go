@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// int128 is a two's complement 128-bit integer. Sums of int64 prices need
+// it: 2^63 prices of up to 2^63 in magnitude sum to less than 2^126.
+type int128 struct {
+	hi int64
+	lo uint64
+}
+
+func int128From(v int64) int128 {
+	return int128{hi: v >> 63, lo: uint64(v)}
+}
+
+func (x int128) add(y int128) int128 {
+	lo, carry := bits.Add64(x.lo, y.lo, 0)
+	return int128{hi: x.hi + y.hi + int64(carry), lo: lo}
+}
+
+func (x int128) sub(y int128) int128 {
+	lo, borrow := bits.Sub64(x.lo, y.lo, 0)
+	return int128{hi: x.hi - y.hi - int64(borrow), lo: lo}
+}
+
+func (x int128) neg() int128 {
+	return int128{}.sub(x)
+}
+
+// mulInt64 returns v * u, which always fits.
+func mulInt64(v int64, u uint64) int128 {
+	magnitude := uint64(v)
+	if v < 0 {
+		magnitude = uint64(-v)
+	}
+	hi, lo := bits.Mul64(magnitude, u)
+	x := int128{hi: int64(hi), lo: lo}
+	if v < 0 {
+		return x.neg()
+	}
+	return x
+}
+
+// quoRem returns the quotient and remainder of |x| / d and whether x is
+// negative, for d > 0. The quotient must fit in a uint64.
+func (x int128) quoRem(d uint64) (q, r uint64, negative bool) {
+	negative = x.hi < 0
+	if negative {
+		x = x.neg()
+	}
+	// Reduce the high word first so that Div64 cannot overflow
+	_, rem := bits.Div64(0, uint64(x.hi), d)
+	q, r = bits.Div64(rem, x.lo, d)
+	return q, r, negative
+}
+
+// quo returns x / d truncated towards zero, as Go's / does, for d > 0. The
+// quotient must fit in an int64, which holds for a mean.
+func (x int128) quo(d int64) int64 {
+	q, _, negative := x.quoRem(uint64(d))
+	if negative {
+		return -int64(q)
+	}
+	return int64(q)
+}
+
+// scaledQuo returns x * scale / d truncated towards zero, for d > 0, without
+// overflowing where x * scale would. x / d must fit in an int64.
+func (x int128) scaledQuo(d, scale uint64) int128 {
+	q, r, negative := x.quoRem(d)
+	hi, lo := bits.Mul64(q, scale)
+	// r < d, so the scaled remainder divided by d is below scale
+	rhi, rlo := bits.Mul64(r, scale)
+	frac, _ := bits.Div64(rhi, rlo, d)
+	lo, carry := bits.Add64(lo, frac, 0)
+
+	result := int128{hi: int64(hi + carry), lo: lo}
+	if negative {
+		return result.neg()
+	}
+	return result
+}
+
+// saturate returns x clamped to the int64 range.
+func (x int128) saturate() int64 {
+	switch {
+	case x.hi > 0 || (x.hi == 0 && x.lo > math.MaxInt64):
+		return math.MaxInt64
+	case x.hi < -1 || (x.hi == -1 && x.lo < 1<<63):
+		return math.MinInt64
+	}
+	return int64(x.lo)
+}
+
+// appendInt128 appends x as 16 big-endian bytes.
+func appendInt128(b []byte, x int128) []byte {
+	b = binary.BigEndian.AppendUint64(b, uint64(x.hi))
+	return binary.BigEndian.AppendUint64(b, x.lo)
+}
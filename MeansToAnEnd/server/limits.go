@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrorFrame is sent in place of a reply when the server refuses a frame
+// but keeps the connection open, to sessions that are tagged, speak version
+// 2 or are on a server that reports protocol errors. It is the opcode, an ErrorCode as a
+// big-endian uint32 and the byte offset of the refused frame in the
+// connection's input as a big-endian uint64. In protocol version 2 the
+// frame is preceded by its length.
+const (
+	ErrorFrame     byte = 'E'
+	ErrorFrameSize int  = 13
+)
+
+// ErrorCode says why a frame was refused.
+type ErrorCode uint32
+
+const (
+	// ErrorSessionLimit means the session's private series is full.
+	ErrorSessionLimit ErrorCode = 1
+	// ErrorMemoryBudget means the server-wide memory budget is spent.
+	ErrorMemoryBudget ErrorCode = 2
+)
+
+var (
+	ErrSessionLimit = errors.New("session point limit reached")
+	ErrMemoryBudget = errors.New("memory budget exhausted")
+)
+
+// pointBytes estimates the memory one stored point takes.
+const pointBytes = int64(unsafe.Sizeof(indexNode{}))
+
+// LimitPolicy decides what an insert does when it would take a series past
+// its limit.
+type LimitPolicy int
+
+const (
+	// LimitReject drops the insert and answers with an error frame on
+	// sessions that expect them.
+	LimitReject LimitPolicy = iota
+	// LimitEvict deletes the oldest point of the series to make room.
+	LimitEvict
+	// LimitDisconnect closes the connection.
+	LimitDisconnect
+)
+
+var limitPolicyNames = map[LimitPolicy]string{
+	LimitReject:     "reject",
+	LimitEvict:      "evict-oldest",
+	LimitDisconnect: "disconnect",
+}
+
+func (p LimitPolicy) String() string {
+	if name, ok := limitPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("LimitPolicy(%d)", int(p))
+}
+
+// ParseLimitPolicy accepts the names printed by String. An empty name
+// selects LimitReject.
+func ParseLimitPolicy(name string) (LimitPolicy, error) {
+	if name == "" {
+		return LimitReject, nil
+	}
+	for p, n := range limitPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown limit policy %q (want reject, evict-oldest or disconnect)", name)
+}
+
+// limitError is returned for a frame refused with code, such as an insert
+// under LimitReject, which is answered as refuse says rather than with a
+// disconnect.
+type limitError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *limitError) Error() string { return e.err.Error() }
+func (e *limitError) Unwrap() error { return e.err }
+
+// makeRoom checks that sr can take one more point, enforcing the session
+// limit and then the memory budget. The caller holds the write lock and must
+// release the budget again if the point is not stored.
+func (sr *series) makeRoom() error {
+	if sr.limit > 0 && sr.prices.Len() >= sr.limit {
+		if err := sr.enforce(sr.limitPolicy, ErrorSessionLimit, ErrSessionLimit); err != nil {
+			return err
+		}
+	}
+	if !sr.budget.reserve(1) {
+		if err := sr.enforce(sr.budget.policy, ErrorMemoryBudget, ErrMemoryBudget); err != nil {
+			return err
+		}
+		// The new point takes the room the evicted one gave back
+		sr.budget.charge(1)
+	}
+	return nil
+}
+
+// enforce applies policy to an insert that sr has no room for.
+func (sr *series) enforce(policy LimitPolicy, code ErrorCode, err error) error {
+	if !sr.limitLogged {
+		sr.limitLogged = true
+		log.Printf("Series %s: %v with %d points, applying %s", sr, err, sr.prices.Len(), policy)
+	}
+
+	switch policy {
+	case LimitEvict:
+		if sr.prices.Len() > 0 {
+			return sr.evictOldest()
+		}
+		// Nothing of this series' own to give up
+		return &limitError{code: code, err: err}
+	case LimitReject:
+		return &limitError{code: code, err: err}
+	default:
+		return err
+	}
+}
+
+// evictOldest deletes the oldest point of sr. The caller holds the write
+// lock.
+func (sr *series) evictOldest() error {
+	if sr.log != nil {
+		if err := sr.log.append(recordEvict, 0, 0); err != nil {
+			return err
+		}
+	}
+	sr.prices.DeleteOldest()
+	sr.budget.release(1)
+	return nil
+}
+
+// memoryBudget bounds the points held by every series on the server
+// together. A nil budget is unlimited and counts nothing.
+type memoryBudget struct {
+	points int64 // zero for no limit
+	policy LimitPolicy
+	used   atomic.Int64
+}
+
+func newMemoryBudget(bytes int64, policy LimitPolicy) *memoryBudget {
+	return &memoryBudget{points: bytes / pointBytes, policy: policy}
+}
+
+// reserve takes room for n more points and reports whether it was there.
+// Without a limit it always succeeds.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if b.points > 0 && used+n > b.points {
+			return false
+		}
+		if b.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// charge counts n more points whether or not there is room for them, as for
+// series recovered from disk.
+func (b *memoryBudget) charge(n int64) {
+	if b != nil {
+		b.used.Add(n)
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b != nil {
+		b.used.Add(-n)
+	}
+}
+
+// usage returns the points in use and an estimate of their size in bytes.
+func (b *memoryBudget) usage() (points, bytes int64) {
+	if b == nil {
+		return 0, 0
+	}
+	points = b.used.Load()
+	return points, points * pointBytes
+}
+
+func errorPayload(code ErrorCode, offset int64) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(code))
+	return binary.BigEndian.AppendUint64(payload, uint64(offset))
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// insertRefused sends an insert that the reject policy refuses and returns
+// the error frame it is answered with.
+func insertRefused(t *testing.T, s *PriceServer, sess *session, timestamp, price int32) []byte {
+	t.Helper()
+	return refused(t, s, sess, decodeV1(message(InsertOperation, timestamp, price)))
+}
+
+// refused sends a frame the server refuses and returns the error frame it is
+// answered with.
+func refused(t *testing.T, s *PriceServer, sess *session, req request) []byte {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	defer conn.Close()
+
+	frame := make([]byte, ErrorFrameSize)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(client, frame)
+		done <- err
+	}()
+	if err := s.respond(conn, req, sess); err != nil {
+		t.Fatalf("Refused %q frame failed: %v", req.op, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to read error frame: %v", err)
+	}
+	return frame
+}
+
+func TestSessionLimitEvictsOldest(t *testing.T) {
+	s := &PriceServer{sessionLimit: 3, sessionPolicy: LimitEvict}
+	sess := s.newSession()
+	for i := int32(1); i <= 5; i++ {
+		if err := insert(t, s, sess, i, i*100); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+	if n := sess.private.prices.Len(); n != 3 {
+		t.Errorf("Expected 3 points, got %d", n)
+	}
+	if got := query(t, s, sess, 0, 10); got != 400 {
+		t.Errorf("Expected mean of the newest 3 points to be 400, got %d", got)
+	}
+
+	// Overwriting a stored timestamp does not need room
+	if err := insert(t, s, sess, 5, 800); err != nil || sess.private.prices.Len() != 3 {
+		t.Errorf("Overwrite at the limit failed: %v with %d points", err, sess.private.prices.Len())
+	}
+}
+
+func TestSessionLimitRejectsWithErrorFrame(t *testing.T) {
+	s := &PriceServer{sessionLimit: 1, sessionPolicy: LimitReject, protocolErrors: ProtocolErrorReport}
+	sess := s.newSession()
+	if err := insert(t, s, sess, 1, 100); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	sess.offset = 9
+	frame := insertRefused(t, s, sess, 2, 200)
+	if frame[0] != ErrorFrame {
+		t.Errorf("Expected error frame, got opcode %q", frame[0])
+	}
+	if code := ErrorCode(binary.BigEndian.Uint32(frame[1:5])); code != ErrorSessionLimit {
+		t.Errorf("Expected code %d, got %d", ErrorSessionLimit, code)
+	}
+	if offset := binary.BigEndian.Uint64(frame[5:13]); offset != 9 {
+		t.Errorf("Expected offset 9, got %d", offset)
+	}
+	if got := query(t, s, sess, 0, 10); got != 100 {
+		t.Errorf("Expected the refused price to be dropped, got mean %d", got)
+	}
+}
+
+func TestRefusalsNeedOptIn(t *testing.T) {
+	s := &PriceServer{sessionLimit: 1, sessionPolicy: LimitReject, store: newSeriesStore(nil)}
+	s.store.maxSeries = 1
+	sess := s.newSession()
+	insert(t, s, sess, 1, 100)
+
+	// A plain version 1 client never gets a reply to an insert
+	var out bytes.Buffer
+	if err := s.respond(&out, decodeV1(message(InsertOperation, 2, 200)), sess); err != nil || out.Len() > 0 {
+		t.Errorf("Expected a silently dropped insert, got %x (error %v)", out.Bytes(), err)
+	}
+	if got := query(t, s, sess, 0, 10); got != 100 {
+		t.Errorf("Expected the refused price to be dropped, got mean %d", got)
+	}
+
+	// but is waiting for the reply to an attach
+	s.processAttach(io.Discard, request{op: AttachOperation, name: "a"}, sess)
+	if err := s.respond(&out, request{op: AttachOperation, name: "b"}, sess); !errors.Is(err, ErrSeriesLimit) || out.Len() > 0 {
+		t.Errorf("Expected ErrSeriesLimit and no reply, got %x (error %v)", out.Bytes(), err)
+	}
+
+	// Version 2 clients read error frames
+	sess = s.newSession()
+	sess.proto = Version2
+	insert(t, s, sess, 1, 100)
+	if err := s.respond(&out, request{op: InsertOperation, args: [3]int64{2, 200}}, sess); err != nil || out.Len() == 0 {
+		t.Errorf("Expected an error frame in version 2, got %x (error %v)", out.Bytes(), err)
+	}
+}
+
+func TestSessionLimitDisconnects(t *testing.T) {
+	s := &PriceServer{sessionLimit: 1, sessionPolicy: LimitDisconnect}
+	sess := s.newSession()
+	insert(t, s, sess, 1, 100)
+	if err := insert(t, s, sess, 2, 200); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Expected ErrSessionLimit, got %v", err)
+	}
+}
+
+func TestMemoryBudgetIsShared(t *testing.T) {
+	budget := newMemoryBudget(2*pointBytes, LimitReject)
+	s := &PriceServer{budget: budget, protocolErrors: ProtocolErrorReport}
+	first, second := s.newSession(), s.newSession()
+
+	insert(t, s, first, 1, 100)
+	insert(t, s, second, 1, 100)
+	frame := insertRefused(t, s, first, 2, 200)
+	if code := ErrorCode(binary.BigEndian.Uint32(frame[1:5])); code != ErrorMemoryBudget {
+		t.Errorf("Expected code %d, got %d", ErrorMemoryBudget, code)
+	}
+
+	// Closing a session gives its points back
+	second.close()
+	if points, bytes := budget.usage(); points != 1 || bytes != pointBytes {
+		t.Errorf("Expected 1 point in use, got %d (%d bytes)", points, bytes)
+	}
+	if err := insert(t, s, first, 2, 200); err != nil {
+		t.Errorf("Insert after release failed: %v", err)
+	}
+}
+
+func TestSeriesLimitRefusesNewSeries(t *testing.T) {
+	s := &PriceServer{store: newSeriesStore(nil), protocolErrors: ProtocolErrorReport}
+	s.store.maxSeries = 2
+	sess := s.newSession()
+
+	for _, name := range []string{"a", "b", "a"} {
+		if err := s.processAttach(io.Discard, request{op: AttachOperation, name: name}, sess); err != nil {
+			t.Fatalf("Attach to %q failed: %v", name, err)
+		}
+	}
+
+	frame := refused(t, s, sess, request{op: AttachOperation, name: "c"})
+	if code := ErrorCode(binary.BigEndian.Uint32(frame[1:5])); frame[0] != ErrorFrame || code != ErrorSeriesLimit {
+		t.Errorf("Expected error frame with code %d, got %x", ErrorSeriesLimit, frame)
+	}
+	if sess.current.name != "a" {
+		t.Errorf("Refused attach switched the session to %s", sess.current)
+	}
+
+	// Existing series and the private one stay reachable
+	for _, name := range []string{"b", ""} {
+		if err := s.processAttach(io.Discard, request{op: AttachOperation, name: name}, sess); err != nil {
+			t.Errorf("Attach to %q after refusal failed: %v", name, err)
+		}
+	}
+}
+
+func TestMemoryBudgetEvictionIsLogged(t *testing.T) {
+	dir := t.TempDir()
+	budget := newMemoryBudget(2*pointBytes, LimitEvict)
+	st, err := openSeriesStore(dir, FsyncNever, 0, 0, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, _ := st.get("feed")
+	for i := int64(1); i <= 4; i++ {
+		if err := sr.insert(DuplicateOverwrite, i, i); err != nil {
+			t.Fatalf("Insert %d failed: %v", i, err)
+		}
+	}
+	want := collect(sr)
+	st.close()
+
+	budget = newMemoryBudget(0, LimitEvict)
+	st, err = openSeriesStore(dir, FsyncNever, 0, 0, budget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	sr, _ = st.get("feed")
+	if got := collect(sr); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+	if points, _ := budget.usage(); points != 2 {
+		t.Errorf("Expected recovered points to be charged, got %d", points)
+	}
+}
+
+func TestParseLimitPolicy(t *testing.T) {
+	for p, name := range limitPolicyNames {
+		if got, err := ParseLimitPolicy(name); err != nil || got != p {
+			t.Errorf("ParseLimitPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if got, err := ParseLimitPolicy(""); err != nil || got != LimitReject {
+		t.Errorf("Expected reject by default, got %v, %v", got, err)
+	}
+	if _, err := ParseLimitPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
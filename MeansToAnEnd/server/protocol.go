@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// VersionOperation switches the connection to another protocol version. In
+// version 1 its frame is the opcode, the version as a big-endian uint32 and
+// four zero bytes; in version 2 the version is an int64 field. The reply is
+// the version as a big-endian uint32, sent in the layout of the version the
+// request arrived in. Every frame after it uses the new version. A
+// connection with subscriptions cannot change version.
+//
+// Version 1 is the default and uses the fixed-size frames described by
+// MessageSize and the opcode constants, with int32 timestamps and prices.
+//
+// In version 2 every frame, in either direction, is its length as a
+// big-endian uint32 followed by that many bytes. A request is the opcode
+// followed by its fields as big-endian int64, in the order version 1 uses:
+// timestamp and price for an insert, minTime and maxTime for queries, plus
+// the width for candles and the interval in milliseconds for a subscribe.
+// An attach carries the bare name and an import the bare points, each a
+// timestamp and a price. Frames from the server start with a type byte:
+// ReplyFrame, PushFrame or ErrorFrame. Replies carry the version 1 reply
+// with every price and timestamp widened to int64, sums to 128 bits, and
+// V2PointSize points in exports. A frame that gets no reply in version 1,
+// such as an insert, gets none in version 2.
+const (
+	VersionOperation byte = 'V'
+
+	V2PointSize = 16
+	// MaxV2FrameSize bounds the length of a version 2 request.
+	MaxV2FrameSize = 1 + MaxImportPoints*V2PointSize
+)
+
+// protocol is a protocol version.
+type protocol uint32
+
+const (
+	Version1 protocol = 1
+	Version2 protocol = 2
+)
+
+var (
+	ErrBadFrame           = errors.New("malformed frame")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrVersionSwitch      = errors.New("cannot switch protocol version with active subscriptions")
+)
+
+// request is a frame from a client, decoded from either version.
+type request struct {
+	op     byte
+	args   [3]int64
+	name   string  // AttachOperation
+	points []point // ImportOperation
+	size   int     // bytes the frame took on the wire
+}
+
+type point struct {
+	timestamp, price int64
+}
+
+// frameReader reads requests from a connection.
+type frameReader struct {
+	r   *bufio.Reader
+	buf []byte // grown on demand, as few connections send the largest frames
+}
+
+func newFrameReader(r *bufio.Reader) *frameReader {
+	return &frameReader{r: r, buf: make([]byte, MessageSize+MaxSeriesName)}
+}
+
+func (fr *frameReader) fill(n int) ([]byte, error) {
+	if n > len(fr.buf) {
+		fr.buf = append(fr.buf, make([]byte, n-len(fr.buf))...)
+	}
+	_, err := io.ReadFull(fr.r, fr.buf[:n])
+	return fr.buf[:n], err
+}
+
+func (fr *frameReader) read(proto protocol) (request, error) {
+	if proto == Version2 {
+		return fr.readV2()
+	}
+
+	header, err := fr.fill(MessageSize)
+	if err != nil {
+		return request{}, err
+	}
+	size, err := frameSize(header)
+	if err != nil {
+		return request{}, err
+	}
+	if size > MessageSize {
+		if len(fr.buf) < size {
+			fr.buf = append(fr.buf[:MessageSize], make([]byte, size-MessageSize)...)
+		}
+		if _, err := io.ReadFull(fr.r, fr.buf[MessageSize:size]); err != nil {
+			return request{}, err
+		}
+	}
+	return decodeV1(fr.buf[:size]), nil
+}
+
+func (fr *frameReader) readV2() (request, error) {
+	header, err := fr.fill(4)
+	if err != nil {
+		return request{}, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > MaxV2FrameSize {
+		return request{}, fmt.Errorf("%w: length %d", ErrBadFrame, length)
+	}
+	body, err := fr.fill(int(length))
+	if err != nil {
+		return request{}, err
+	}
+	return decodeV2(body)
+}
+
+// buffered reports whether a complete frame is waiting to be read, so that
+// reading it cannot block.
+func (fr *frameReader) buffered(proto protocol) bool {
+	if proto == Version2 {
+		if fr.r.Buffered() < 4 {
+			return false
+		}
+		header, _ := fr.r.Peek(4)
+		length := binary.BigEndian.Uint32(header)
+		// A bad frame fails without blocking too
+		return length == 0 || length > MaxV2FrameSize || fr.r.Buffered() >= 4+int(length)
+	}
+	return frameBuffered(fr.r)
+}
+
+func int32Field(data []byte) int64 {
+	return int64(int32(binary.BigEndian.Uint32(data)))
+}
+
+// decodeV1 decodes a whole version 1 frame, as sized by frameSize.
+func decodeV1(data []byte) request {
+	req := request{op: data[0], size: len(data)}
+	switch req.op {
+	case AttachOperation:
+		req.name = string(data[MessageSize:])
+		return req
+	case ImportOperation:
+		for p := data[MessageSize:]; len(p) >= PointSize; p = p[PointSize:] {
+			req.points = append(req.points, point{int32Field(p[0:4]), int32Field(p[4:8])})
+		}
+		return req
+	case VersionOperation:
+		req.args[0] = int64(binary.BigEndian.Uint32(data[1:5]))
+		return req
+	case SubscribeOperation:
+		req.args[2] = int64(binary.BigEndian.Uint32(data[9:13]))
+	case CandleOperation, MovingAverageOperation:
+		req.args[2] = int32Field(data[9:13])
+	}
+	req.args[0], req.args[1] = int32Field(data[1:5]), int32Field(data[5:9])
+	return req
+}
+
+// decodeV2 decodes the body of a version 2 frame, after its length.
+func decodeV2(data []byte) (request, error) {
+	req := request{op: data[0], size: 4 + len(data)}
+	payload := data[1:]
+
+	fields := 0
+	switch op := req.op; {
+	case op == AttachOperation:
+		if len(payload) > MaxSeriesName {
+			return req, fmt.Errorf("%w: series name of %d bytes exceeds limit of %d", ErrBadFrame, len(payload), MaxSeriesName)
+		}
+		req.name = string(payload)
+		return req, nil
+	case op == ImportOperation:
+		if len(payload)%V2PointSize != 0 {
+			return req, fmt.Errorf("%w: import of %d bytes", ErrBadFrame, len(payload))
+		}
+		req.points = make([]point, 0, len(payload)/V2PointSize)
+		for p := payload; len(p) > 0; p = p[V2PointSize:] {
+			req.points = append(req.points, point{int64(binary.BigEndian.Uint64(p[0:8])), int64(binary.BigEndian.Uint64(p[8:16]))})
+		}
+		return req, nil
+	case op == VersionOperation:
+		fields = 1
+	case op == CandleOperation, op == SubscribeOperation, op == MovingAverageOperation:
+		fields = 3
+	case op == InsertOperation, op == QueryOperation, op == ExportOperation, op == TWAPOperation, isAggregateOperation(op):
+		fields = 2
+	default:
+		// Left for processMessage to reject
+		return req, nil
+	}
+
+	if len(payload) != fields*8 {
+		return req, fmt.Errorf("%w: %q frame with %d bytes of fields", ErrBadFrame, req.op, len(payload))
+	}
+	for i := range fields {
+		req.args[i] = int64(binary.BigEndian.Uint64(payload[i*8:]))
+	}
+	return req, nil
+}
+
+// appendValue appends a price or timestamp: an int32 in version 1, clamped
+// to its range, or an int64 in version 2. Exports check the range first, as
+// a clamped point would pass for a stored one.
+func (p protocol) appendValue(b []byte, v int64) []byte {
+	if p == Version2 {
+		return binary.BigEndian.AppendUint64(b, uint64(v))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(int32(min(max(v, math.MinInt32), math.MaxInt32))))
+}
+
+// appendSum appends a sum of prices or a fixed-point average: an int64 in
+// version 1, clamped to its range, or 128 bits in version 2.
+func (p protocol) appendSum(b []byte, sum int128) []byte {
+	if p == Version2 {
+		return appendInt128(b, sum)
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(sum.saturate()))
+}
+
+// pointSize is the size of a point in exports and imports.
+func (p protocol) pointSize() int {
+	if p == Version2 {
+		return V2PointSize
+	}
+	return PointSize
+}
+
+// writeFrame writes a frame of type typ that is not a bare version 1 reply:
+// the type and payload, preceded in version 2 by their length.
+func writeFrame(w io.Writer, proto protocol, typ byte, payload []byte) error {
+	frame := make([]byte, 0, 5+len(payload))
+	if proto == Version2 {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(1+len(payload)))
+	}
+	frame = append(append(frame, typ), payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// respond answers a frame in the layout of the session's protocol version:
+// a bare reply in version 1, preceded by ReplyFrame once the session is in
+// tagged mode, or a ReplyFrame frame in version 2. A refused frame is
+// answered as refuse says, and one that reads below the retention horizon as
+// the horizon policy says.
+func (s *PriceServer) respond(w io.Writer, req request, sess *session) error {
+	if ok, err := s.checkHorizon(w, req, sess); !ok || err != nil {
+		return err
+	}
+
+	proto := sess.proto
+	if proto == Version1 && !sess.tagged && req.op != SubscribeOperation {
+		err := s.processMessage(w, req, sess)
+		var refused *limitError
+		if errors.As(err, &refused) {
+			return s.refuse(w, req, sess, refused)
+		}
+		return err
+	}
+
+	// Collect the reply so it goes out in one write, which pushes from other
+	// goroutines cannot split
+	var reply bytes.Buffer
+	err := s.processMessage(&reply, req, sess)
+
+	var writeErr error
+	var refused *limitError
+	switch {
+	case errors.As(err, &refused):
+		err = nil
+		writeErr = writeError(w, sess, refused.code)
+	case reply.Len() > 0:
+		writeErr = writeFrame(w, proto, ReplyFrame, reply.Bytes())
+	}
+	if writeErr != nil && err == nil {
+		err = fmt.Errorf("failed to write response: %w", writeErr)
+	}
+
+	// A new subscription pushes only once the reply announcing it is out
+	if err == nil {
+		sess.startPushers()
+	}
+	return err
+}
+
+// refuse answers a refused frame with an error frame if the session can
+// tell one from a reply: it is tagged, speaks version 2 or the server
+// reports protocol errors. Otherwise a refused insert is dropped without a
+// word, as inserts have never had a reply in version 1, and any other
+// refused frame fails like a protocol error, since its client waits for a
+// reply that will not come.
+func (s *PriceServer) refuse(w io.Writer, req request, sess *session, refused *limitError) error {
+	if sess.tagged || sess.proto == Version2 || s.protocolErrors != ProtocolErrorDisconnect {
+		return writeError(w, sess, refused.code)
+	}
+	if req.op == InsertOperation {
+		return nil
+	}
+	return refused
+}
+
+func (s *PriceServer) processVersion(w io.Writer, req request, sess *session) error {
+	// Checked before converting, so that a version 2 field cannot wrap
+	// around to a known version
+	if req.args[0] != int64(Version1) && req.args[0] != int64(Version2) {
+		return fmt.Errorf("%w %d", ErrUnsupportedVersion, req.args[0])
+	}
+	version := protocol(req.args[0])
+	if len(sess.subscriptions) > 0 {
+		return fmt.Errorf("%w: to version %d", ErrVersionSwitch, version)
+	}
+
+	reply := binary.BigEndian.AppendUint32(nil, uint32(version))
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	sess.proto = version
+	return nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestDecodeV2(t *testing.T) {
+	body := []byte{CandleOperation}
+	for _, v := range []int64{-1 << 40, 1 << 40, 3600} {
+		body = binary.BigEndian.AppendUint64(body, uint64(v))
+	}
+	req, err := decodeV2(body)
+	if err != nil {
+		t.Fatalf("decodeV2 failed: %v", err)
+	}
+	if req.op != CandleOperation || req.args != [3]int64{-1 << 40, 1 << 40, 3600} || req.size != 4+len(body) {
+		t.Errorf("Unexpected request %+v", req)
+	}
+
+	for _, bad := range [][]byte{
+		{InsertOperation, 0, 0, 0, 0, 0, 0, 0, 1},
+		append([]byte{QueryOperation}, make([]byte, 24)...),
+		append([]byte{ImportOperation}, make([]byte, 24)...),
+	} {
+		if _, err := decodeV2(bad); !errors.Is(err, ErrBadFrame) {
+			t.Errorf("Expected ErrBadFrame for %q frame of %d bytes, got %v", bad[0], len(bad), err)
+		}
+	}
+	if _, err := decodeV2(append([]byte{AttachOperation}, make([]byte, MaxSeriesName+1)...)); err == nil {
+		t.Error("Expected an error for an oversized name")
+	}
+}
+
+func TestVersion1RepliesClamp(t *testing.T) {
+	for _, c := range []struct{ v, want int64 }{
+		{1 << 40, math.MaxInt32},
+		{-1 << 40, math.MinInt32},
+		{-5, -5},
+	} {
+		if got := int64(int32(binary.BigEndian.Uint32(Version1.appendValue(nil, c.v)))); got != c.want {
+			t.Errorf("appendValue(%d) = %d, want %d", c.v, got, c.want)
+		}
+	}
+
+	big := int128From(math.MaxInt64).add(int128From(1))
+	if got := int64(binary.BigEndian.Uint64(Version1.appendSum(nil, big))); got != math.MaxInt64 {
+		t.Errorf("Expected the sum to clamp to MaxInt64, got %d", got)
+	}
+	if got := Version2.appendSum(nil, big); len(got) != 16 || binary.BigEndian.Uint64(got[8:]) != 1<<63 {
+		t.Errorf("Expected the full 128-bit sum, got %x", got)
+	}
+}
+
+func TestInt128Quo(t *testing.T) {
+	// Three prices near the int64 limits, whose sums overflow an int64
+	var sum, negSum int128
+	for range 3 {
+		sum = sum.add(int128From(math.MaxInt64 - 1))
+		negSum = negSum.add(int128From(math.MinInt64 + 1))
+	}
+	if got := sum.quo(3); got != math.MaxInt64-1 {
+		t.Errorf("Expected mean %d, got %d", int64(math.MaxInt64-1), got)
+	}
+	if got := negSum.quo(3); got != math.MinInt64+1 {
+		t.Errorf("Expected mean %d, got %d", int64(math.MinInt64+1), got)
+	}
+	if got := int128From(-7).quo(2); got != -3 {
+		t.Errorf("Expected -7/2 to truncate to -3, got %d", got)
+	}
+	if sum.saturate() != math.MaxInt64 || negSum.saturate() != math.MinInt64 || int128From(-9).saturate() != -9 {
+		t.Errorf("Unexpected saturation of %v, %v", sum, negSum)
+	}
+}
+
+func TestVersion1ExportRefusesOutOfRange(t *testing.T) {
+	insert := binary.BigEndian.AppendUint32(nil, 17)
+	insert = append(insert, InsertOperation)
+	insert = binary.BigEndian.AppendUint64(insert, 1)
+	insert = binary.BigEndian.AppendUint64(insert, 1<<40)
+	toVersion1 := binary.BigEndian.AppendUint32(nil, 9)
+	toVersion1 = append(toVersion1, VersionOperation)
+	toVersion1 = binary.BigEndian.AppendUint64(toVersion1, 1)
+
+	// The export starts after the switch (9), the insert (21) and the
+	// switch back (13)
+	out, closed := serve(t, ProtocolErrorSkip,
+		message(VersionOperation, 2, 0), insert, toVersion1,
+		message(ExportOperation, 0, 10),
+		message(QueryOperation, 5, 10),
+	)
+	want := []byte{0, 0, 0, 2, 0, 0, 0, 5, ReplyFrame, 0, 0, 0, 1}
+	want = append(want, errorFrame(ErrorValueOutOfRange, 43)...)
+	want = append(want, 0, 0, 0, 0)
+	if string(out) != string(want) || closed {
+		t.Errorf("Expected %x on an open connection, got %x (closed %v)", want, out, closed)
+	}
+}
+
+func TestVersionSwitchRefusesWrappedVersion(t *testing.T) {
+	s := &PriceServer{}
+	sess := s.newSession()
+	sess.proto = Version2
+
+	var out bytes.Buffer
+	req := request{op: VersionOperation, args: [3]int64{1<<32 + 2}}
+	if err := s.processVersion(&out, req, sess); !errors.Is(err, ErrUnsupportedVersion) || out.Len() != 0 {
+		t.Errorf("Expected ErrUnsupportedVersion without a reply, got %x: %v", out.Bytes(), err)
+	}
+	if sess.proto != Version2 {
+		t.Errorf("Expected the session to stay on version 2, got %d", sess.proto)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolErrorPolicy decides what the server does with a frame it cannot
+// serve, such as one with an unknown opcode. Clients that do not expect
+// error frames get the silent disconnect the protocol has always had.
+type ProtocolErrorPolicy int
+
+const (
+	// ProtocolErrorDisconnect closes the connection without a word.
+	ProtocolErrorDisconnect ProtocolErrorPolicy = iota
+	// ProtocolErrorReport sends an error frame and then closes the
+	// connection.
+	ProtocolErrorReport
+	// ProtocolErrorSkip sends an error frame and goes on with the next
+	// frame. A frame whose length cannot be known still closes the
+	// connection, as do refusals under the disconnect limit policy.
+	ProtocolErrorSkip
+)
+
+// Error codes for frames the server cannot serve, continuing the codes for
+// refused inserts.
+const (
+	// ErrorUnknownOperation means the opcode is not one the server knows.
+	ErrorUnknownOperation ErrorCode = 3
+	// ErrorMalformedFrame means the frame has the wrong length or layout.
+	ErrorMalformedFrame ErrorCode = 4
+	// ErrorInvalidRequest means the frame is well formed but asks for
+	// something the server will not do, such as candles of zero width.
+	ErrorInvalidRequest ErrorCode = 5
+	// ErrorDuplicateTimestamp means an insert was refused under the reject
+	// duplicate policy.
+	ErrorDuplicateTimestamp ErrorCode = 6
+	// ErrorUnsupportedVersion means a version switch asked for an unknown
+	// protocol version.
+	ErrorUnsupportedVersion ErrorCode = 7
+)
+
+var ErrUnknownOperation = errors.New("unknown operation")
+
+var protocolErrorPolicyNames = map[ProtocolErrorPolicy]string{
+	ProtocolErrorDisconnect: "disconnect",
+	ProtocolErrorReport:     "report",
+	ProtocolErrorSkip:       "skip",
+}
+
+func (p ProtocolErrorPolicy) String() string {
+	if name, ok := protocolErrorPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("ProtocolErrorPolicy(%d)", int(p))
+}
+
+// ParseProtocolErrorPolicy accepts the names printed by String. An empty
+// name selects ProtocolErrorDisconnect.
+func ParseProtocolErrorPolicy(name string) (ProtocolErrorPolicy, error) {
+	if name == "" {
+		return ProtocolErrorDisconnect, nil
+	}
+	for p, n := range protocolErrorPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown protocol error policy %q (want disconnect, report or skip)", name)
+}
+
+// protocolErrorCode returns the code for an error caused by a client's
+// frame, and false for other errors, such as failed writes, which are never
+// reported.
+func protocolErrorCode(err error) (ErrorCode, bool) {
+	switch {
+	case errors.Is(err, ErrUnknownOperation):
+		return ErrorUnknownOperation, true
+	case errors.Is(err, ErrBadFrame):
+		return ErrorMalformedFrame, true
+	case errors.Is(err, ErrUnsupportedVersion):
+		return ErrorUnsupportedVersion, true
+	case errors.Is(err, ErrDuplicateTimestamp):
+		return ErrorDuplicateTimestamp, true
+	case errors.Is(err, ErrSessionLimit):
+		return ErrorSessionLimit, true
+	case errors.Is(err, ErrMemoryBudget):
+		return ErrorMemoryBudget, true
+	case errors.Is(err, ErrSeriesLimit):
+		return ErrorSeriesLimit, true
+	case errors.Is(err, ErrValueOutOfRange):
+		return ErrorValueOutOfRange, true
+	case errors.Is(err, ErrPastHorizon):
+		return ErrorRetentionHorizon, true
+	case errors.Is(err, ErrBadCandleQuery), errors.Is(err, ErrBadMovingAverageQuery),
+		errors.Is(err, ErrTooManySubscriptions), errors.Is(err, ErrVersionSwitch),
+		errors.Is(err, ErrSeriesNameTooLong):
+		return ErrorInvalidRequest, true
+	}
+	return 0, false
+}
+
+// handleProtocolError applies the policy to err, which failed the frame at
+// sess.offset. synced is whether the whole frame was read, so that the next
+// one can be. It reports whether the connection can go on.
+func (s *PriceServer) handleProtocolError(w io.Writer, err error, sess *session, synced bool) bool {
+	code, ok := protocolErrorCode(err)
+	if !ok || s.protocolErrors == ProtocolErrorDisconnect {
+		return false
+	}
+	if writeErr := writeError(w, sess, code); writeErr != nil {
+		return false
+	}
+
+	// The disconnect limit policy asks for the connection to close
+	limited := code == ErrorSessionLimit || code == ErrorMemoryBudget
+	return s.protocolErrors == ProtocolErrorSkip && synced && !limited
+}
+
+// writeError answers the frame at sess.offset with an error frame.
+func writeError(w io.Writer, sess *session, code ErrorCode) error {
+	return writeCodedFrame(w, sess, ErrorFrame, code)
+}
+
+// writeCodedFrame answers the frame at sess.offset with a frame of type typ
+// in the layout of an error frame, preceded by ReplyFrame in a tagged
+// version 1 session like any other answer.
+func writeCodedFrame(w io.Writer, sess *session, typ byte, code ErrorCode) error {
+	if sess.proto == Version1 && sess.tagged {
+		frame := append([]byte{typ}, errorPayload(code, sess.offset)...)
+		if err := writeFrame(w, Version1, ReplyFrame, frame); err != nil {
+			return fmt.Errorf("failed to write error frame: %w", err)
+		}
+		return nil
+	}
+	if err := writeFrame(w, sess.proto, typ, errorPayload(code, sess.offset)); err != nil {
+		return fmt.Errorf("failed to write error frame: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve starts a server with the given policy on one end of a pipe, sends
+// frames from the other and returns everything the server writes, and
+// whether it closed the connection rather than going quiet.
+func serve(t *testing.T, policy ProtocolErrorPolicy, frames ...[]byte) ([]byte, bool) {
+	t.Helper()
+	s := &PriceServer{store: newSeriesStore(nil), protocolErrors: policy}
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.wg.Add(1)
+	go s.handleConnection(conn)
+
+	go func() {
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+
+	var out []byte
+	buf := make([]byte, 256)
+	for {
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := client.Read(buf)
+		out = append(out, buf[:n]...)
+		if err != nil {
+			return out, err == io.EOF
+		}
+	}
+}
+
+func errorFrame(code ErrorCode, offset int64) []byte {
+	return append([]byte{ErrorFrame}, errorPayload(code, offset)...)
+}
+
+func TestProtocolErrorSkip(t *testing.T) {
+	out, closed := serve(t, ProtocolErrorSkip,
+		message('Z', 0, 0),
+		message(InsertOperation, 1, 100),
+		message(QueryOperation, 0, 10),
+	)
+	want := append(errorFrame(ErrorUnknownOperation, 0), 0, 0, 0, 100)
+	if string(out) != string(want) || closed {
+		t.Errorf("Expected %x on an open connection, got %x (closed %v)", want, out, closed)
+	}
+}
+
+func TestProtocolErrorReport(t *testing.T) {
+	out, closed := serve(t, ProtocolErrorReport,
+		message(InsertOperation, 1, 100),
+		message('Z', 0, 0),
+		message(QueryOperation, 0, 10),
+	)
+	if string(out) != string(errorFrame(ErrorUnknownOperation, 9)) || !closed {
+		t.Errorf("Expected an error frame at offset 9 and a disconnect, got %x (closed %v)", out, closed)
+	}
+}
+
+func TestProtocolErrorDisconnectIsSilent(t *testing.T) {
+	if out, closed := serve(t, ProtocolErrorDisconnect, message('Z', 0, 0)); len(out) != 0 || !closed {
+		t.Errorf("Expected a disconnect without a reply, got %x (closed %v)", out, closed)
+	}
+}
+
+func TestProtocolErrorSkipClosesOnUnreadableFrame(t *testing.T) {
+	// The name is too long to read, so the next frame cannot be found
+	out, closed := serve(t, ProtocolErrorSkip, message(AttachOperation, int32(MaxSeriesName)+1, 0))
+	if string(out) != string(errorFrame(ErrorMalformedFrame, 0)) || !closed {
+		t.Errorf("Expected a malformed frame error and a disconnect, got %x (closed %v)", out, closed)
+	}
+}
+
+func TestProtocolErrorSkipVersion2(t *testing.T) {
+	badInsert := binary.BigEndian.AppendUint32(nil, 9)
+	badInsert = append(badInsert, InsertOperation, 0, 0, 0, 0, 0, 0, 0, 1)
+	query := binary.BigEndian.AppendUint32(nil, 17)
+	query = append(query, QueryOperation)
+	query = binary.BigEndian.AppendUint64(query, 0)
+	query = binary.BigEndian.AppendUint64(query, 10)
+
+	out, _ := serve(t, ProtocolErrorSkip, message(VersionOperation, 2, 0), badInsert, query)
+	want := []byte{0, 0, 0, 2}
+	want = append(want, 0, 0, 0, byte(ErrorFrameSize))
+	want = append(want, errorFrame(ErrorMalformedFrame, 9)...)
+	want = append(want, 0, 0, 0, 9, ReplyFrame, 0, 0, 0, 0, 0, 0, 0, 0)
+	if string(out) != string(want) {
+		t.Errorf("Expected %x, got %x", want, out)
+	}
+}
+
+func TestParseProtocolErrorPolicy(t *testing.T) {
+	for p, name := range protocolErrorPolicyNames {
+		if got, err := ParseProtocolErrorPolicy(name); err != nil || got != p {
+			t.Errorf("ParseProtocolErrorPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if got, err := ParseProtocolErrorPolicy(""); err != nil || got != ProtocolErrorDisconnect {
+		t.Errorf("Expected disconnect by default, got %v, %v", got, err)
+	}
+	if _, err := ParseProtocolErrorPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
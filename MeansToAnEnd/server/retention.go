@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// A session's private series can be given a retention window: a background
+// sweep drops the points more than the window behind the newest timestamp
+// inserted in the session. Named series are shared, so no one session's
+// timestamps can decide what they keep, and they are never swept.
+//
+// Once points have been dropped, a frame that reads below the horizon they
+// were dropped at gets an answer that may be missing data. Under
+// HorizonPartial the reply is preceded by a NoticeFrame, which has the
+// layout of an error frame with ErrorRetentionHorizon as its code, in
+// sessions that are tagged or speak version 2; an untagged version 1 client
+// could not tell the notice from its reply, so it gets the reply alone.
+// Under HorizonError the frame is refused with that code: an error frame
+// takes the place of the reply where the client can tell one from a reply,
+// and otherwise the connection is closed. Subscriptions are checked again on
+// every push.
+const (
+	NoticeFrame byte = 'N'
+
+	// ErrorRetentionHorizon means a frame read below the retention horizon.
+	ErrorRetentionHorizon ErrorCode = 8
+)
+
+var ErrPastHorizon = errors.New("read below the retention horizon")
+
+// HorizonPolicy decides how a frame that reads below the retention horizon
+// is answered.
+type HorizonPolicy int
+
+const (
+	// HorizonPartial answers as usual after a notice that the answer may
+	// be partial.
+	HorizonPartial HorizonPolicy = iota
+	// HorizonError refuses the frame as refuse says.
+	HorizonError
+)
+
+var horizonPolicyNames = map[HorizonPolicy]string{
+	HorizonPartial: "partial",
+	HorizonError:   "error",
+}
+
+func (p HorizonPolicy) String() string {
+	if name, ok := horizonPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("HorizonPolicy(%d)", int(p))
+}
+
+// ParseHorizonPolicy accepts the names printed by String. An empty name
+// selects HorizonPartial.
+func ParseHorizonPolicy(name string) (HorizonPolicy, error) {
+	if name == "" {
+		return HorizonPartial, nil
+	}
+	for p, n := range horizonPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown horizon policy %q (want partial or error)", name)
+}
+
+// retention is the retention state of a series, guarded by its lock.
+type retention struct {
+	window  int64
+	newest  int64
+	seen    bool
+	horizon int64 // points below it have been dropped, if dropped > 0
+	dropped int64
+}
+
+func (r *retention) observe(timestamp int64) {
+	if r.window > 0 && (!r.seen || timestamp > r.newest) {
+		r.newest, r.seen = timestamp, true
+	}
+}
+
+// cutoff returns the oldest timestamp the window keeps.
+func (r *retention) cutoff() int64 {
+	if r.newest < math.MinInt64+r.window-1 {
+		return math.MinInt64
+	}
+	return r.newest - r.window + 1
+}
+
+// expire drops the points that have fallen out of the retention window and
+// returns how many it dropped.
+func (sr *series) expire() int {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	r := &sr.retention
+	if r.window <= 0 || !r.seen {
+		return 0
+	}
+	cutoff := r.cutoff()
+	n := sr.prices.DeleteBefore(cutoff)
+	if n > 0 {
+		r.horizon = cutoff
+		r.dropped += int64(n)
+		sr.budget.release(int64(n))
+		sr.notify()
+	}
+	return n
+}
+
+// pastHorizon reports whether reading from minTime on could miss points
+// that retention dropped.
+func (sr *series) pastHorizon(minTime int64) bool {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	return sr.retention.dropped > 0 && minTime < sr.retention.horizon
+}
+
+// expireEvery sweeps the session's private series every interval until stop
+// is closed.
+func (s *PriceServer) expireEvery(sess *session, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if n := sess.private.expire(); n > 0 && sess.addr != nil {
+			log.Printf("Retention dropped %d points from %s", n, sess.addr)
+		}
+	}
+}
+
+// earliest returns the oldest timestamp a frame reads, and false for frames
+// that read no range.
+func (s *PriceServer) earliest(req request) (int64, bool) {
+	switch op := req.op; {
+	case op == MovingAverageOperation:
+		minTime, _ := s.queryRange(req)
+		if window := req.args[2]; window > 0 && minTime >= math.MinInt64+window-1 {
+			return minTime - window + 1, true
+		}
+		return math.MinInt64, true
+	case op == QueryOperation, op == CandleOperation, op == TWAPOperation,
+		op == ExportOperation, op == SubscribeOperation, isAggregateOperation(op):
+		minTime, maxTime := s.queryRange(req)
+		// An empty range reads nothing
+		return minTime, minTime <= maxTime
+	}
+	return 0, false
+}
+
+// checkHorizon answers a frame that reads below the retention horizon as the
+// policy says, and reports whether the frame should still be processed.
+func (s *PriceServer) checkHorizon(w io.Writer, req request, sess *session) (bool, error) {
+	minTime, ok := s.earliest(req)
+	if !ok || !sess.current.pastHorizon(minTime) {
+		return true, nil
+	}
+	if s.horizonPolicy == HorizonError {
+		refused := &limitError{code: ErrorRetentionHorizon, err: fmt.Errorf("%w: reads from %d", ErrPastHorizon, minTime)}
+		return false, s.refuse(w, req, sess, refused)
+	}
+	// A notice would pass for the reply in an untagged version 1 session
+	if !sess.tagged && sess.proto == Version1 {
+		return true, nil
+	}
+	return true, writeCodedFrame(w, sess, NoticeFrame, ErrorRetentionHorizon)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpire(t *testing.T) {
+	budget := newMemoryBudget(0, LimitReject)
+	s := &PriceServer{budget: budget, retention: 100}
+	sess := s.newSession()
+	for i := int32(1); i <= 300; i++ {
+		insert(t, s, sess, i, i)
+	}
+
+	if n := sess.private.expire(); n != 200 {
+		t.Fatalf("Expected 200 points dropped, got %d", n)
+	}
+	if got := query(t, s, sess, 201, 300); got != 250 {
+		t.Errorf("Expected the newest 100 points to remain, got mean %d", got)
+	}
+	if points, _ := budget.usage(); points != 100 {
+		t.Errorf("Expected dropped points to be released, got %d in use", points)
+	}
+	if n := sess.private.expire(); n != 0 {
+		t.Errorf("Expected nothing more to drop, got %d", n)
+	}
+}
+
+func TestRetentionHorizonPolicies(t *testing.T) {
+	for _, policy := range []HorizonPolicy{HorizonPartial, HorizonError} {
+		s := &PriceServer{retention: 10, horizonPolicy: policy}
+		sess := s.newSession()
+		for i := int32(1); i <= 20; i++ {
+			insert(t, s, sess, i, 100)
+		}
+
+		// Nothing has been dropped yet, so every answer is complete
+		var out bytes.Buffer
+		if err := s.respond(&out, decodeV1(message(QueryOperation, 0, 20)), sess); err != nil || out.Len() != 4 {
+			t.Fatalf("%s: expected a plain reply before the sweep, got %x: %v", policy, out.Bytes(), err)
+		}
+
+		sess.private.expire()
+		sess.offset = 189
+		// An untagged version 1 client could not tell a notice or an error
+		// frame from the reply, so it gets the reply alone or a disconnect
+		out.Reset()
+		err := s.respond(&out, decodeV1(message(QueryOperation, 0, 20)), sess)
+		if policy == HorizonPartial && (err != nil || out.String() != "\x00\x00\x00\x64") {
+			t.Fatalf("%s: expected a plain reply when untagged, got %x: %v", policy, out.Bytes(), err)
+		}
+		if policy == HorizonError && (!errors.Is(err, ErrPastHorizon) || out.Len() != 0) {
+			t.Fatalf("%s: expected a refusal without an answer when untagged, got %x: %v", policy, out.Bytes(), err)
+		}
+
+		sess.proto = Version2
+		typ, reply := ErrorFrame, []byte(nil)
+		if policy == HorizonPartial {
+			typ, reply = NoticeFrame, []byte{0, 0, 0, 9, ReplyFrame, 0, 0, 0, 0, 0, 0, 0, 100}
+		}
+		out.Reset()
+		if err := s.respond(&out, decodeV1(message(QueryOperation, 0, 20)), sess); err != nil {
+			t.Fatalf("%s: query failed: %v", policy, err)
+		}
+		frame := out.Bytes()[4:]
+		if len(frame) != ErrorFrameSize+len(reply) || frame[0] != typ {
+			t.Fatalf("%s: unexpected answer %x", policy, frame)
+		}
+		if code := ErrorCode(binary.BigEndian.Uint32(frame[1:5])); code != ErrorRetentionHorizon {
+			t.Errorf("%s: expected code %d, got %d", policy, ErrorRetentionHorizon, code)
+		}
+		if offset := binary.BigEndian.Uint64(frame[5:13]); offset != 189 {
+			t.Errorf("%s: expected offset 189, got %d", policy, offset)
+		}
+		if !bytes.Equal(frame[ErrorFrameSize:], reply) {
+			t.Errorf("%s: expected reply %x, got %x", policy, reply, frame[ErrorFrameSize:])
+		}
+
+		// Within the window the answer is complete
+		sess.proto = Version1
+		out.Reset()
+		s.respond(&out, decodeV1(message(QueryOperation, 11, 20)), sess)
+		if out.Len() != 4 {
+			t.Errorf("%s: expected a plain reply within the window, got %x", policy, out.Bytes())
+		}
+	}
+}
+
+func TestRetentionHorizonOnPushes(t *testing.T) {
+	for _, policy := range []HorizonPolicy{HorizonPartial, HorizonError} {
+		s := &PriceServer{retention: 10, horizonPolicy: policy}
+		sess := s.newSession()
+		for i := int32(1); i <= 20; i++ {
+			insert(t, s, sess, i, i)
+		}
+
+		client, conn := net.Pipe()
+		sess.out = newReplyWriter(conn, 0)
+		read := func(n int) []byte {
+			t.Helper()
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(client, buf); err != nil {
+				t.Fatalf("%s: expected %d bytes: %v", policy, n, err)
+			}
+			return buf
+		}
+
+		sess.offset = 27
+		subscribe := append(message(SubscribeOperation, 0, 20), 0, 0, 0, 0)
+		go s.respond(sess.out, decodeV1(subscribe), sess)
+		if got := read(5 + PushFrameSize); !bytes.Equal(got, []byte{ReplyFrame, 0, 0, 0, 0, PushFrame, 0, 0, 0, 0, 0, 0, 0, 10}) {
+			t.Fatalf("%s: unexpected reply and first push %x", policy, got)
+		}
+
+		// The sweep drops the range's oldest points after the subscribe
+		sess.private.expire()
+		want := append([]byte{NoticeFrame}, errorPayload(ErrorRetentionHorizon, 27)...)
+		want = append(want, PushFrame, 0, 0, 0, 0, 0, 0, 0, 15)
+		if policy == HorizonError {
+			want = append([]byte{ErrorFrame}, errorPayload(ErrorRetentionHorizon, 27)...)
+		}
+		if got := read(len(want)); !bytes.Equal(got, want) {
+			t.Errorf("%s: expected %x after the sweep, got %x", policy, want, got)
+		}
+
+		client.Close()
+		sess.unsubscribe()
+	}
+}
+
+func TestRetentionSweepsInBackground(t *testing.T) {
+	s := &PriceServer{retention: 5, retentionInterval: time.Millisecond}
+	sess := s.newSession()
+	for i := int32(1); i <= 50; i++ {
+		insert(t, s, sess, i, i)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.expireEvery(sess, stop)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		var n int
+		sess.private.read(func(prices *priceIndex) { n = prices.Len() })
+		if n == 5 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Expected the sweep to leave 5 points")
+}
+
+func TestParseHorizonPolicy(t *testing.T) {
+	for p, name := range horizonPolicyNames {
+		if got, err := ParseHorizonPolicy(name); err != nil || got != p {
+			t.Errorf("ParseHorizonPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if got, err := ParseHorizonPolicy(""); err != nil || got != HorizonPartial {
+		t.Errorf("Expected partial by default, got %v, %v", got, err)
+	}
+	if _, err := ParseHorizonPolicy("ignore"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AttachOperation switches a connection to a named series that other
+// connections can share. The frame is the opcode, the name length as a
+// big-endian uint32 and four zero bytes, followed by the name. A zero
+// length name returns the connection to its private series. The reply is
+// the number of prices in the series as a big-endian int64. An attach that
+// would create a series past the server's maximum is refused with an error
+// frame and leaves the connection where it was. With a data directory,
+// names longer than MaxPersistentSeriesName are invalid requests.
+const (
+	AttachOperation byte = 'A'
+	MaxSeriesName   int  = 255
+)
+
+// MaxPersistentSeriesName bounds the names of persistent series, whose
+// directory names spell them out in hex and must fit the usual 255 byte
+// limit on file names.
+const MaxPersistentSeriesName = 127
+
+// ErrorSeriesLimit means an attach would create a named series past the
+// server's maximum.
+const ErrorSeriesLimit ErrorCode = 9
+
+var (
+	ErrSeriesLimit       = errors.New("series limit reached")
+	ErrSeriesNameTooLong = errors.New("series name too long to persist")
+)
+
+// series is a set of prices read and written by one or more connections.
+type series struct {
+	name   string // empty for a connection's private series
+	mutex  sync.RWMutex
+	prices *priceIndex
+	log    *seriesLog // nil unless the series is persistent
+
+	// Bounds on the points held; a zero limit is unlimited
+	limit       int
+	limitPolicy LimitPolicy
+	budget      *memoryBudget
+	limitLogged bool
+
+	// Subscriptions to signal on every change
+	watchers map[chan struct{}]struct{}
+
+	// Retention of a private series; a zero window keeps every point
+	retention retention
+}
+
+func (sr *series) String() string {
+	if sr.name == "" {
+		return "(private)"
+	}
+	return fmt.Sprintf("%q", sr.name)
+}
+
+func newSeries(name string) *series {
+	return &series{name: name, prices: newPriceIndex()}
+}
+
+// insert stores a price under the write lock. A persistent series logs the
+// change before applying it.
+func (sr *series) insert(policy DuplicatePolicy, timestamp, price int64) error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	kind, err := policy.resolve(sr.prices, timestamp)
+	if err != nil || kind == recordNone {
+		return err
+	}
+
+	_, exists := sr.prices.Get(timestamp)
+	grows := kind == recordAdd || !exists
+	if grows {
+		if err := sr.makeRoom(); err != nil {
+			return err
+		}
+	}
+	if sr.log != nil {
+		if err := sr.log.append(kind, timestamp, price); err != nil {
+			if grows {
+				sr.budget.release(1)
+			}
+			return err
+		}
+	}
+	kind.apply(sr.prices, timestamp, price)
+	sr.retention.observe(timestamp)
+	sr.notify()
+
+	if sr.log != nil && sr.log.needsCompaction() {
+		// The insert is already logged, so a failed compaction only costs
+		// a longer replay on the next start. Readers and writers wait while
+		// the points are copied; the snapshot is written in the background.
+		if err := sr.log.compact(sr.prices); err != nil {
+			log.Printf("Failed to compact series %q: %v", sr.name, err)
+		}
+	}
+	return nil
+}
+
+// read runs fn with the prices under the read lock.
+func (sr *series) read(fn func(prices *priceIndex)) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	fn(sr.prices)
+}
+
+// seriesStore holds the named series shared between connections. Series are
+// created on first attach and live as long as the server, so their number is
+// bounded by maxSeries. With a data directory every named series is
+// persistent and is recovered on startup, whatever the bound.
+type seriesStore struct {
+	mutex     sync.Mutex
+	series    map[string]*series
+	maxSeries int // zero is unlimited
+
+	budget *memoryBudget
+
+	dataDir      string
+	fsync        FsyncPolicy
+	compactAfter int
+
+	// Background work on the logs, stopped by close
+	done    chan struct{}
+	workers sync.WaitGroup
+}
+
+func newSeriesStore(budget *memoryBudget) *seriesStore {
+	return &seriesStore{series: make(map[string]*series), budget: budget}
+}
+
+// openSeriesStore recovers every series stored in dataDir. With FsyncInterval
+// the logs are synced every interval until the store is closed.
+func openSeriesStore(dataDir string, fsync FsyncPolicy, interval time.Duration, compactAfter int, budget *memoryBudget) (*seriesStore, error) {
+	st := newSeriesStore(budget)
+	st.dataDir, st.fsync, st.compactAfter = dataDir, fsync, compactAfter
+
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, err := hex.DecodeString(entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		sr, err := st.get(string(name))
+		if err != nil {
+			st.close()
+			return nil, fmt.Errorf("failed to recover series %q: %w", name, err)
+		}
+		log.Printf("Recovered series %q with %d prices", name, sr.prices.Len())
+	}
+
+	if fsync == FsyncInterval {
+		st.background(func(done <-chan struct{}) {
+			st.syncEvery(done, interval)
+		})
+	}
+	return st, nil
+}
+
+// background runs fn until close closes done.
+func (st *seriesStore) background(fn func(done <-chan struct{})) {
+	if st.done == nil {
+		st.done = make(chan struct{})
+	}
+	st.workers.Add(1)
+	go func() {
+		defer st.workers.Done()
+		fn(st.done)
+	}()
+}
+
+// closeIdleLogs closes, every timeout, the logs of series that were not
+// written to for timeout. They are reopened by their next write.
+func (st *seriesStore) closeIdleLogs(timeout time.Duration) {
+	st.background(func(done <-chan struct{}) {
+		ticker := time.NewTicker(timeout)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				for _, l := range st.logs() {
+					if err := l.closeIfIdle(now, timeout); err != nil {
+						log.Printf("Failed to close idle %s: %v", l.dir, err)
+					}
+				}
+			}
+		}
+	})
+}
+
+func (st *seriesStore) get(name string) (*series, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if sr, ok := st.series[name]; ok {
+		return sr, nil
+	}
+	if st.maxSeries > 0 && len(st.series) >= st.maxSeries {
+		return nil, &limitError{code: ErrorSeriesLimit, err: fmt.Errorf("%w: %d series", ErrSeriesLimit, len(st.series))}
+	}
+
+	if st.dataDir != "" && len(name) > MaxPersistentSeriesName {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrSeriesNameTooLong, len(name), MaxPersistentSeriesName)
+	}
+
+	sr := newSeries(name)
+	sr.budget = st.budget
+	if st.dataDir != "" {
+		// Hex keeps arbitrary names safe as directory names
+		dir := filepath.Join(st.dataDir, hex.EncodeToString([]byte(name)))
+		l, err := openSeriesLog(dir, st.fsync, st.compactAfter, sr.prices)
+		if err != nil {
+			return nil, err
+		}
+		sr.log = l
+		st.budget.charge(int64(sr.prices.Len()))
+	}
+	st.series[name] = sr
+	return sr, nil
+}
+
+func (st *seriesStore) logs() []*seriesLog {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var logs []*seriesLog
+	for _, sr := range st.series {
+		if sr.log != nil {
+			logs = append(logs, sr.log)
+		}
+	}
+	return logs
+}
+
+func (st *seriesStore) syncEvery(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, l := range st.logs() {
+				if err := l.sync(); err != nil {
+					log.Printf("Failed to sync %s: %v", l.dir, err)
+				}
+			}
+		}
+	}
+}
+
+// close stops the background work and syncs and closes every log.
+func (st *seriesStore) close() error {
+	if st.done != nil {
+		close(st.done)
+		st.workers.Wait()
+		st.done = nil
+	}
+
+	var errs []error
+	for _, l := range st.logs() {
+		errs = append(errs, l.close())
+	}
+	return errors.Join(errs...)
+}
+
+// session is the state of one connection. Connections that never attach
+// only ever see their private series.
+type session struct {
+	private *series
+	current *series
+
+	addr  net.Addr // nil outside a real connection
+	proto protocol
+
+	// offset is the position of the current frame in the connection's input
+	offset int64
+
+	// Set by the first subscribe; pushes go to out until done is closed
+	tagged        bool
+	subscriptions []*subscription
+	out           *replyWriter
+	done          chan struct{}
+	pushers       sync.WaitGroup
+}
+
+func newSession() *session {
+	private := newSeries("")
+	return &session{private: private, current: private, proto: Version1}
+}
+
+// newSession starts a session whose private series is bounded by the
+// server's limits.
+func (s *PriceServer) newSession() *session {
+	sess := newSession()
+	sess.private.limit = s.sessionLimit
+	sess.private.limitPolicy = s.sessionPolicy
+	sess.private.budget = s.budget
+	sess.private.retention.window = s.retention
+	return sess
+}
+
+// close gives the private series' points back to the memory budget.
+func (sess *session) close() {
+	sess.private.mutex.Lock()
+	defer sess.private.mutex.Unlock()
+	sess.private.budget.release(int64(sess.private.prices.Len()))
+}
+
+func (s *PriceServer) processAttach(w io.Writer, req request, sess *session) error {
+	name := req.name
+	if name == "" {
+		sess.current = sess.private
+	} else {
+		sr, err := s.store.get(name)
+		if err != nil {
+			return fmt.Errorf("failed to open series %q: %w", name, err)
+		}
+		sess.current = sr
+	}
+	if sess.addr != nil {
+		log.Printf("%s attached to series %q", sess.addr, name)
+	}
+
+	var count int
+	sess.current.read(func(prices *priceIndex) {
+		count = prices.Len()
+	})
+
+	reply := binary.BigEndian.AppendUint64(nil, uint64(count))
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
@@ -1,12 +1,18 @@
 package server
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/bhaski-1234/protohackers/MeansToAnEnd/config"
 )
@@ -17,132 +23,350 @@ const (
 	MessageSize     int  = 9
 )
 
+// frameSize returns the length of the frame whose first MessageSize bytes
+// are header. Frames are MessageSize bytes unless the opcode carries more.
+func frameSize(header []byte) (int, error) {
+	switch header[0] {
+	case CandleOperation:
+		return CandleMessageSize, nil
+	case MovingAverageOperation:
+		return MovingAverageMessageSize, nil
+	case SubscribeOperation:
+		return SubscribeMessageSize, nil
+	case AttachOperation:
+		nameLen := binary.BigEndian.Uint32(header[1:5])
+		if nameLen > uint32(MaxSeriesName) {
+			return 0, fmt.Errorf("%w: series name of %d bytes exceeds limit of %d", ErrBadFrame, nameLen, MaxSeriesName)
+		}
+		return MessageSize + int(nameLen), nil
+	case ImportOperation:
+		count := binary.BigEndian.Uint32(header[1:5])
+		if count > MaxImportPoints {
+			return 0, fmt.Errorf("%w: import of %d points exceeds limit of %d", ErrBadFrame, count, MaxImportPoints)
+		}
+		return MessageSize + int(count)*PointSize, nil
+	}
+	return MessageSize, nil
+}
+
 // PriceServer handles the means-to-an-end protocol
 type PriceServer struct {
-	listener net.Listener
-	wg       sync.WaitGroup
+	listener          net.Listener
+	wg                sync.WaitGroup
+	connsMutex        sync.Mutex
+	conns             map[net.Conn]struct{} // nil once stopping
+	swapReversedRange bool
+	duplicates        DuplicatePolicy
+	store             *seriesStore
+
+	sessionLimit  int
+	sessionPolicy LimitPolicy
+	budget        *memoryBudget
+	flushDelay    time.Duration
+
+	minPushInterval time.Duration
+	protocolErrors  ProtocolErrorPolicy
+
+	retention         int64
+	retentionInterval time.Duration
+	horizonPolicy     HorizonPolicy
 }
 
 // NewServer creates a new price server
 func NewServer() (*PriceServer, error) {
+	duplicates, err := ParseDuplicatePolicy(config.DuplicatePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionPolicy, err := ParseLimitPolicy(config.SessionLimitPolicy)
+	if err != nil {
+		return nil, err
+	}
+	budgetPolicy, err := ParseLimitPolicy(config.MemoryBudgetPolicy)
+	if err != nil {
+		return nil, err
+	}
+	budget := newMemoryBudget(config.MemoryBudget, budgetPolicy)
+
+	protocolErrors, err := ParseProtocolErrorPolicy(config.ProtocolErrors)
+	if err != nil {
+		return nil, err
+	}
+	horizonPolicy, err := ParseHorizonPolicy(config.RetentionQueries)
+	if err != nil {
+		return nil, err
+	}
+	if config.Retention > 0 && config.RetentionInterval <= 0 {
+		return nil, fmt.Errorf("retention interval must be positive, got %v", config.RetentionInterval)
+	}
+
+	store := newSeriesStore(budget)
+	if config.DataDir != "" {
+		fsync, err := ParseFsyncPolicy(config.Fsync)
+		if err != nil {
+			return nil, err
+		}
+		if fsync == FsyncInterval && config.FsyncInterval <= 0 {
+			return nil, fmt.Errorf("fsync interval must be positive, got %v", config.FsyncInterval)
+		}
+		store, err = openSeriesStore(config.DataDir, fsync, config.FsyncInterval, config.CompactAfter, budget)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open data directory: %w", err)
+		}
+		if config.LogIdleTimeout > 0 {
+			store.closeIdleLogs(config.LogIdleTimeout)
+		}
+	}
+	store.maxSeries = config.MaxSeries
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port))
 	if err != nil {
+		store.close()
 		return nil, fmt.Errorf("failed to create listener: %w", err)
 	}
 
 	return &PriceServer{
-		listener: listener,
+		listener:          listener,
+		conns:             make(map[net.Conn]struct{}),
+		swapReversedRange: config.SwapReversedRange,
+		duplicates:        duplicates,
+		store:             store,
+		sessionLimit:      config.SessionLimit,
+		sessionPolicy:     sessionPolicy,
+		budget:            budget,
+		flushDelay:        config.FlushDelay,
+		minPushInterval:   config.MinPushInterval,
+		protocolErrors:    protocolErrors,
+		retention:         config.Retention,
+		retentionInterval: config.RetentionInterval,
+		horizonPolicy:     horizonPolicy,
 	}, nil
 }
 
-// Start begins accepting connections
+// Start accepts connections until the listener is closed by Stop.
 func (s *PriceServer) Start() {
 	log.Printf("Server listening on %s:%d", config.Host, config.Port)
 
 	for {
 		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("Failed to accept connection: %v", err)
 			continue
 		}
-
-		s.wg.Add(1)
+		if !s.track(conn) {
+			conn.Close()
+			return
+		}
 		go s.handleConnection(conn)
 	}
 }
 
-// Stop gracefully shuts down the server
+// track registers a new connection for Stop to close. It reports false once
+// the server is stopping.
+func (s *PriceServer) track(conn net.Conn) bool {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+
+	if s.conns == nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *PriceServer) untrack(conn net.Conn) {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	delete(s.conns, conn)
+}
+
+// Stop closes the listener and every connection, waits for the connections
+// to finish and then syncs and closes the stored series.
 func (s *PriceServer) Stop() error {
 	err := s.listener.Close()
-	s.wg.Wait() // Wait for all connections to finish
-	return err
+
+	s.connsMutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+	s.connsMutex.Unlock()
+
+	s.wg.Wait()
+	return errors.Join(err, s.store.close())
 }
 
 func (s *PriceServer) handleConnection(conn net.Conn) {
-	defer conn.Close()
 	defer s.wg.Done()
+	defer s.untrack(conn)
+	defer conn.Close()
 
-	log.Printf("New connection from %s", conn.RemoteAddr())
+	log.Printf("New connection from %s (duplicate policy: %s)", conn.RemoteAddr(), s.duplicates)
 
-	// Map of timestamp to price for this connection
-	priceMap := make(map[uint32]uint32)
-	buf := make([]byte, MessageSize)
+	// Pipelined frames are read and answered in batches rather than with a
+	// syscall each
+	r := bufio.NewReaderSize(conn, ioBufferSize)
+	w := newReplyWriter(conn, s.flushDelay)
+	defer w.Flush()
+
+	// Prices inserted on this connection, until it attaches to a named series
+	sess := s.newSession()
+	sess.addr = conn.RemoteAddr()
+	sess.out = w
+	defer s.closeSession(conn, sess)
+	defer sess.unsubscribe()
+	if s.retention > 0 {
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.expireEvery(sess, stop)
+		}()
+		// The sweep must be over before the session gives back its points
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	frames := newFrameReader(r)
 
 	for {
-		_, err := io.ReadFull(conn, buf)
+		// Replies are only held back while more frames are already waiting
+		if !frames.buffered(sess.proto) {
+			if err := w.Flush(); err != nil {
+				log.Printf("Error writing to %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+
+		req, err := frames.read(sess.proto)
 		if err != nil {
 			if err == io.EOF {
 				log.Printf("Connection closed by client: %s", conn.RemoteAddr())
-			} else {
-				log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+				return
 			}
-			return
-		}
-
-		if err := s.processMessage(conn, buf, priceMap); err != nil {
+			log.Printf("Error reading from %s: %v", conn.RemoteAddr(), err)
+			// A frame that was read whole can be skipped
+			if !s.handleProtocolError(w, err, sess, req.size > 0) {
+				return
+			}
+		} else if err := s.respond(w, req, sess); err != nil {
 			log.Printf("Error processing message from %s: %v", conn.RemoteAddr(), err)
-			return
+			if !s.handleProtocolError(w, err, sess, true) {
+				return
+			}
 		}
+		sess.offset += int64(req.size)
 	}
 }
 
-func (s *PriceServer) processMessage(conn net.Conn, data []byte, priceMap map[uint32]uint32) error {
-	switch data[0] {
-	case InsertOperation:
-		timestamp := binary.BigEndian.Uint32(data[1:5])
-		price := binary.BigEndian.Uint32(data[5:9])
-		priceMap[timestamp] = price
-		return nil
+// closeSession releases the session's points and logs what is still in use.
+func (s *PriceServer) closeSession(conn net.Conn, sess *session) {
+	held, dropped := sess.private.prices.Len(), sess.private.retention.dropped
+	sess.close()
 
-	case QueryOperation:
-		minTime := binary.BigEndian.Uint32(data[1:5])
-		maxTime := binary.BigEndian.Uint32(data[5:9])
+	points, bytes := s.budget.usage()
+	log.Printf("Session %s released %d points (%d dropped by retention); %d points (~%d bytes) in use", conn.RemoteAddr(), held, dropped, points, bytes)
+}
 
-		if maxTime < minTime {
-			// Swap for consistency with problem definition
-			minTime, maxTime = maxTime, minTime
-		}
+func (s *PriceServer) processMessage(w io.Writer, req request, sess *session) error {
+	switch op := req.op; {
+	case op == InsertOperation:
+		// A refused insert reaches respond as a limitError
+		return sess.current.insert(s.duplicates, req.args[0], req.args[1])
 
-		avgPrice := calculateAverage(priceMap, minTime, maxTime)
+	case op == QueryOperation:
+		minTime, maxTime := s.queryRange(req)
 
-		responseData := make([]byte, 4)
-		binary.BigEndian.PutUint32(responseData, avgPrice)
+		// An empty or reversed range has no prices, so the mean is 0
+		var avgPrice int64
+		sess.current.read(func(prices *priceIndex) {
+			avgPrice = calculateAverage(prices, minTime, maxTime)
+		})
 
-		if _, err := conn.Write(responseData); err != nil {
+		if _, err := w.Write(sess.proto.appendValue(nil, avgPrice)); err != nil {
 			return fmt.Errorf("failed to write response: %w", err)
 		}
 		return nil
 
+	case op == CandleOperation:
+		return s.processCandles(w, req, sess)
+
+	case op == TWAPOperation:
+		return s.processTWAP(w, req, sess)
+
+	case op == MovingAverageOperation:
+		return s.processMovingAverages(w, req, sess)
+
+	case op == AttachOperation:
+		return s.processAttach(w, req, sess)
+
+	case op == ExportOperation:
+		return s.processExport(w, req, sess)
+
+	case op == ImportOperation:
+		return s.processImport(w, req, sess)
+
+	case op == SubscribeOperation:
+		return s.processSubscribe(w, req, sess)
+
+	case op == VersionOperation:
+		return s.processVersion(w, req, sess)
+
+	case isAggregateOperation(op):
+		return s.processAggregate(w, req, sess)
+
 	default:
-		return fmt.Errorf("unknown operation: %c", data[0])
+		return fmt.Errorf("%w: %c", ErrUnknownOperation, op)
 	}
 }
 
-func calculateAverage(priceMap map[uint32]uint32, minTime, maxTime uint32) uint32 {
-	var total uint64 // Use uint64 to avoid overflow
-	var count uint32
+// queryRange returns the minTime and maxTime of a query.
+func (s *PriceServer) queryRange(req request) (minTime, maxTime int64) {
+	minTime, maxTime = req.args[0], req.args[1]
 
-	for timestamp, price := range priceMap {
-		if timestamp >= minTime && timestamp <= maxTime {
-			total += uint64(price)
-			count++
-		}
+	if maxTime < minTime && s.swapReversedRange {
+		// Compatibility mode for clients that relied on the old swap
+		minTime, maxTime = maxTime, minTime
 	}
+	return minTime, maxTime
+}
 
+func calculateAverage(prices *priceIndex, minTime, maxTime int64) int64 {
+	count, total := prices.Aggregate(minTime, maxTime)
 	if count == 0 {
 		return 0
 	}
 
-	return uint32(total / uint64(count))
+	// The mean of int64 values always fits in an int64
+	return total.quo(count)
 }
 
-// RunServer starts the server and blocks until complete
+// RunServer starts the server and blocks until SIGINT or SIGTERM, then stops
+// it so that the stored series are synced and closed.
 func RunServer() error {
 	server, err := NewServer()
 	if err != nil {
 		return err
 	}
 
-	server.Start()
-	return nil
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		server.Start()
+	}()
+
+	sig := <-signals
+	log.Printf("Received %v, shutting down", sig)
+	err = server.Stop()
+	<-stopped
+	return err
 }
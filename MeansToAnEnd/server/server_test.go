@@ -3,8 +3,13 @@ package server_test
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"math"
 	"net"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func sendMessage(t *testing.T, conn net.Conn, msg []byte) {
@@ -38,6 +43,23 @@ func buildInsert(timestamp, price int32) []byte {
 	return buf.Bytes()
 }
 
+func readResponse64(t *testing.T, conn net.Conn) int64 {
+	t.Helper()
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func buildFrame(op byte, a, b int32) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(op)
+	binary.Write(buf, binary.BigEndian, a)
+	binary.Write(buf, binary.BigEndian, b)
+	return buf.Bytes()
+}
+
 func buildQuery(minTime, maxTime int32) []byte {
 	buf := new(bytes.Buffer)
 	buf.WriteByte('Q')
@@ -109,12 +131,20 @@ func TestQueryWithMinTimeAfterMaxTime(t *testing.T) {
 	}
 	defer conn.Close()
 
+	// Data inside the swapped range makes the two behaviours differ
+	sendMessage(t, conn, buildInsert(2000, 400))
 	sendMessage(t, conn, buildQuery(3000, 1000))
 	result := readResponse(t, conn)
 
 	if result != 0 {
 		t.Errorf("Expected 0 for invalid time range, got %d", result)
 	}
+
+	// The same data is found once the bounds are in order
+	sendMessage(t, conn, buildQuery(1000, 3000))
+	if result := readResponse(t, conn); result != 400 {
+		t.Errorf("Expected 400 for ordered range, got %d", result)
+	}
 }
 
 func TestSessionIsolation(t *testing.T) {
@@ -142,3 +172,557 @@ func TestSessionIsolation(t *testing.T) {
 		t.Errorf("Expected 0 for session isolation, got %d", result)
 	}
 }
+
+func TestNegativePricesAndTimestamps(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildInsert(-3000, -100))
+	sendMessage(t, conn, buildInsert(-2000, -300))
+	sendMessage(t, conn, buildInsert(1000, 700))
+
+	// Range spanning negative and positive timestamps: (-100 - 300 + 700) / 3
+	sendMessage(t, conn, buildQuery(-5000, 5000))
+	if result := readResponse(t, conn); result != 100 {
+		t.Errorf("Expected mean 100, got %d", result)
+	}
+
+	// Range covering only negative timestamps
+	sendMessage(t, conn, buildQuery(-3000, -1))
+	if result := readResponse(t, conn); result != -200 {
+		t.Errorf("Expected mean -200, got %d", result)
+	}
+}
+
+func TestInt32Limits(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildInsert(math.MinInt32, math.MaxInt32))
+	sendMessage(t, conn, buildInsert(math.MinInt32+1, math.MaxInt32))
+	sendMessage(t, conn, buildInsert(math.MaxInt32-1, math.MinInt32))
+	sendMessage(t, conn, buildInsert(math.MaxInt32, math.MinInt32))
+
+	// Sums exceed int32 but the means do not
+	sendMessage(t, conn, buildQuery(math.MinInt32, math.MinInt32+1))
+	if result := readResponse(t, conn); result != math.MaxInt32 {
+		t.Errorf("Expected %d, got %d", int32(math.MaxInt32), result)
+	}
+
+	sendMessage(t, conn, buildQuery(math.MaxInt32-1, math.MaxInt32))
+	if result := readResponse(t, conn); result != math.MinInt32 {
+		t.Errorf("Expected %d, got %d", int32(math.MinInt32), result)
+	}
+
+	// (2*MaxInt32 + 2*MinInt32) / 4 truncates to 0
+	sendMessage(t, conn, buildQuery(math.MinInt32, math.MaxInt32))
+	if result := readResponse(t, conn); result != 0 {
+		t.Errorf("Expected 0, got %d", result)
+	}
+}
+
+func TestAggregateQueries(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Prices 10, 20, ..., 100 inserted out of order, plus one outside the range
+	for _, i := range []int32{7, 2, 9, 4, 1, 10, 3, 8, 5, 6} {
+		sendMessage(t, conn, buildInsert(1000+i, 10*i))
+	}
+	sendMessage(t, conn, buildInsert(5000, -1))
+
+	cases32 := []struct {
+		name string
+		op   byte
+		want int32
+	}{
+		{"min", 'L', 10},
+		{"max", 'H', 100},
+		{"median", 'D', 50},
+		{"p0", 0x80, 10},
+		{"p25", 0x80 + 25, 30},
+		{"p90", 0x80 + 90, 90},
+		{"p91", 0x80 + 91, 100},
+		{"p100", 0x80 + 100, 100},
+	}
+	for _, c := range cases32 {
+		sendMessage(t, conn, buildFrame(c.op, 1000, 2000))
+		if result := readResponse(t, conn); result != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, result)
+		}
+	}
+
+	sendMessage(t, conn, buildFrame('C', 1000, 2000))
+	if result := readResponse64(t, conn); result != 10 {
+		t.Errorf("count: expected 10, got %d", result)
+	}
+	sendMessage(t, conn, buildFrame('S', 1000, 2000))
+	if result := readResponse64(t, conn); result != 550 {
+		t.Errorf("sum: expected 550, got %d", result)
+	}
+
+	// Empty range
+	sendMessage(t, conn, buildFrame('H', 3000, 4000))
+	if result := readResponse(t, conn); result != 0 {
+		t.Errorf("max of empty range: expected 0, got %d", result)
+	}
+	sendMessage(t, conn, buildFrame('C', 3000, 4000))
+	if result := readResponse64(t, conn); result != 0 {
+		t.Errorf("count of empty range: expected 0, got %d", result)
+	}
+}
+
+func TestSumExceedsInt32(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildInsert(1, math.MaxInt32))
+	sendMessage(t, conn, buildInsert(2, math.MaxInt32))
+	sendMessage(t, conn, buildFrame('S', 0, 10))
+	if result := readResponse64(t, conn); result != 2*math.MaxInt32 {
+		t.Errorf("Expected %d, got %d", int64(2*math.MaxInt32), result)
+	}
+}
+
+func TestUnknownOperationDisconnects(t *testing.T) {
+	for _, op := range []byte{'Z', 0x80 + 101} {
+		conn, err := net.Dial("tcp", "localhost:9000")
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		sendMessage(t, conn, buildFrame(op, 0, 10))
+		buf := make([]byte, 1)
+		if _, err := conn.Read(buf); err == nil {
+			t.Errorf("Expected connection to close after opcode %#x", op)
+		}
+		conn.Close()
+	}
+}
+
+type candle struct {
+	Start, Open, High, Low, Close int32
+	Count                         uint32
+}
+
+func readCandles(t *testing.T, conn net.Conn) []candle {
+	t.Helper()
+	var n uint32
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		t.Fatalf("Failed to read candle count: %v", err)
+	}
+	candles := make([]candle, n)
+	if err := binary.Read(conn, binary.BigEndian, candles); err != nil {
+		t.Fatalf("Failed to read candles: %v", err)
+	}
+	return candles
+}
+
+func TestCandles(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Bucket [0, 9]: 5 -> 100, 2 -> 90, 8 -> 120, 6 -> 80 (out of order)
+	// Bucket [10, 19]: empty
+	// Bucket [20, 24]: 24 -> 70
+	for _, p := range [][2]int32{{5, 100}, {2, 90}, {8, 120}, {6, 80}, {24, 70}, {25, 999}} {
+		sendMessage(t, conn, buildInsert(p[0], p[1]))
+	}
+
+	query := binary.BigEndian.AppendUint32(buildFrame('K', 0, 24), 10)
+	sendMessage(t, conn, query)
+
+	got := readCandles(t, conn)
+	want := []candle{
+		{Start: 0, Open: 90, High: 120, Low: 80, Close: 120, Count: 4},
+		{Start: 10},
+		{Start: 20, Open: 70, High: 70, Low: 70, Close: 70, Count: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d candles, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Candle %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+
+	// The connection still serves normal queries afterwards
+	sendMessage(t, conn, buildQuery(0, 9))
+	if result := readResponse(t, conn); result != 97 {
+		t.Errorf("Expected mean 97, got %d", result)
+	}
+}
+
+func TestCandlesRejectZeroWidth(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, binary.BigEndian.AppendUint32(buildFrame('K', 0, 100), 0))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("Expected connection to close after zero-width candle query")
+	}
+}
+
+func buildAttach(name string) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{'A'}, uint32(len(name)))
+	msg = append(msg, 0, 0, 0, 0)
+	return append(msg, name...)
+}
+
+func TestNamedSeriesIsShared(t *testing.T) {
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "localhost:9000")
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		return conn
+	}
+	producer, reader, other := dial(), dial(), dial()
+	defer producer.Close()
+	defer reader.Close()
+	defer other.Close()
+
+	name := t.Name() + "-" + time.Now().Format(time.RFC3339Nano)
+
+	sendMessage(t, producer, buildAttach(name))
+	if count := readResponse64(t, producer); count != 0 {
+		t.Fatalf("Expected new series to be empty, got %d points", count)
+	}
+	sendMessage(t, producer, buildInsert(1000, 100))
+	sendMessage(t, producer, buildInsert(2000, 300))
+
+	// Once the producer has a reply, its inserts are visible to others
+	sendMessage(t, producer, buildQuery(0, 5000))
+	if result := readResponse(t, producer); result != 200 {
+		t.Fatalf("Expected mean 200, got %d", result)
+	}
+	sendMessage(t, reader, buildAttach(name))
+	if count := readResponse64(t, reader); count != 2 {
+		t.Fatalf("Expected 2 points in shared series, got %d", count)
+	}
+	sendMessage(t, reader, buildInsert(3000, 500))
+	sendMessage(t, reader, buildQuery(0, 5000))
+	if result := readResponse(t, reader); result != 300 {
+		t.Errorf("Expected mean 300, got %d", result)
+	}
+	sendMessage(t, producer, buildQuery(0, 5000))
+	if result := readResponse(t, producer); result != 300 {
+		t.Errorf("Expected producer to see mean 300, got %d", result)
+	}
+
+	// A connection that never attaches sees only its own prices
+	sendMessage(t, other, buildInsert(1000, 7))
+	sendMessage(t, other, buildQuery(0, 5000))
+	if result := readResponse(t, other); result != 7 {
+		t.Errorf("Expected isolated mean 7, got %d", result)
+	}
+
+	// An empty name returns to the private series, which is still empty
+	sendMessage(t, reader, buildAttach(""))
+	if count := readResponse64(t, reader); count != 0 {
+		t.Errorf("Expected empty private series, got %d points", count)
+	}
+}
+
+func TestAttachRejectsLongName(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildAttach(strings.Repeat("x", 256)))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("Expected connection to close after oversized series name")
+	}
+}
+
+func TestExportAndImport(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	frame := buildFrame('M', 3, 0)
+	for _, p := range [][2]int32{{30, 3}, {10, 1}, {20, 2}} {
+		frame = binary.BigEndian.AppendUint32(frame, uint32(p[0]))
+		frame = binary.BigEndian.AppendUint32(frame, uint32(p[1]))
+	}
+	sendMessage(t, conn, frame)
+	if accepted := readResponse(t, conn); accepted != 3 {
+		t.Fatalf("Expected 3 points accepted, got %d", accepted)
+	}
+
+	sendMessage(t, conn, buildFrame('X', 15, 100))
+	var got [][2]int32
+	for {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			t.Fatalf("Failed to read record length: %v", err)
+		}
+		if binary.BigEndian.Uint32(length) == 0 {
+			break
+		}
+		point := make([]byte, 8)
+		if _, err := io.ReadFull(conn, point); err != nil {
+			t.Fatalf("Failed to read record: %v", err)
+		}
+		got = append(got, [2]int32{int32(binary.BigEndian.Uint32(point[:4])), int32(binary.BigEndian.Uint32(point[4:]))})
+	}
+	if len(got) != 2 || got[0] != [2]int32{20, 2} || got[1] != [2]int32{30, 3} {
+		t.Errorf("Expected [[20 2] [30 3]], got %v", got)
+	}
+}
+
+func TestImportRejectsTooManyPoints(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildFrame('M', 1<<16+1, 0))
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err == nil {
+		t.Errorf("Expected connection to close after oversized import")
+	}
+}
+
+func readFrame(t *testing.T, conn net.Conn, size int) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	return buf
+}
+
+func TestSubscribePushesMeans(t *testing.T) {
+	subscriber, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer subscriber.Close()
+	producer, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer producer.Close()
+
+	name := t.Name() + "-" + time.Now().Format(time.RFC3339Nano)
+	sendMessage(t, subscriber, buildAttach(name))
+	readResponse64(t, subscriber)
+	sendMessage(t, producer, buildAttach(name))
+	readResponse64(t, producer)
+
+	sendMessage(t, subscriber, binary.BigEndian.AppendUint32(buildFrame('U', 0, 100), 0))
+	if reply := readFrame(t, subscriber, 5); reply[0] != 'R' || binary.BigEndian.Uint32(reply[1:]) != 0 {
+		t.Fatalf("Expected tagged reply with subscription 0, got %v", reply)
+	}
+	push := readFrame(t, subscriber, 9)
+	if push[0] != 'P' || binary.BigEndian.Uint32(push[1:5]) != 0 || binary.BigEndian.Uint32(push[5:]) != 0 {
+		t.Fatalf("Expected initial push of mean 0, got %v", push)
+	}
+
+	// Inserts outside the range do not change the mean
+	sendMessage(t, producer, buildInsert(500, 7))
+	sendMessage(t, producer, buildInsert(10, 100))
+	sendMessage(t, producer, buildInsert(20, 300))
+	var mean int32
+	for mean != 200 {
+		push = readFrame(t, subscriber, 9)
+		if push[0] != 'P' {
+			t.Fatalf("Expected a push, got %v", push)
+		}
+		mean = int32(binary.BigEndian.Uint32(push[5:]))
+		if mean != 100 && mean != 200 {
+			t.Fatalf("Unexpected pushed mean %d", mean)
+		}
+	}
+
+	// Replies on a subscribed connection are tagged
+	sendMessage(t, subscriber, buildQuery(0, 15))
+	if reply := readFrame(t, subscriber, 5); reply[0] != 'R' || binary.BigEndian.Uint32(reply[1:]) != 100 {
+		t.Errorf("Expected tagged reply with mean 100, got %v", reply)
+	}
+}
+
+func buildV2(op byte, fields ...int64) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(1+8*len(fields)))
+	frame = append(frame, op)
+	for _, f := range fields {
+		frame = binary.BigEndian.AppendUint64(frame, uint64(f))
+	}
+	return frame
+}
+
+// readV2Frame reads a version 2 frame and returns its type and payload.
+func readV2Frame(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	length := binary.BigEndian.Uint32(readFrame(t, conn, 4))
+	frame := readFrame(t, conn, int(length))
+	return frame[0], frame[1:]
+}
+
+// dialV2 connects and switches the connection to protocol version 2.
+func dialV2(t *testing.T) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	sendMessage(t, conn, buildFrame('V', 2, 0))
+	if version := binary.BigEndian.Uint32(readFrame(t, conn, 4)); version != 2 {
+		t.Fatalf("Expected version 2, got %d", version)
+	}
+	return conn
+}
+
+func TestVersion2WideValues(t *testing.T) {
+	conn := dialV2(t)
+
+	// The sum of these overflows an int64
+	sendMessage(t, conn, buildV2('I', 1<<40, 1<<62))
+	sendMessage(t, conn, buildV2('I', 1<<40+1, 1<<62+2))
+	sendMessage(t, conn, buildV2('Q', 0, math.MaxInt64))
+
+	typ, payload := readV2Frame(t, conn)
+	if typ != 'R' || len(payload) != 8 {
+		t.Fatalf("Expected an 8-byte reply, got %q with %d bytes", typ, len(payload))
+	}
+	if mean := int64(binary.BigEndian.Uint64(payload)); mean != 1<<62+1 {
+		t.Errorf("Expected mean %d, got %d", int64(1<<62+1), mean)
+	}
+
+	sendMessage(t, conn, buildV2('S', math.MinInt64, math.MaxInt64))
+	_, payload = readV2Frame(t, conn)
+	if len(payload) != 16 {
+		t.Fatalf("Expected a 128-bit sum, got %d bytes", len(payload))
+	}
+	if hi, lo := binary.BigEndian.Uint64(payload[:8]), binary.BigEndian.Uint64(payload[8:]); hi != 0 || lo != 1<<63+2 {
+		t.Errorf("Expected sum 2^63+2, got hi %d lo %d", hi, lo)
+	}
+
+	sendMessage(t, conn, buildV2('H', 0, 1<<40))
+	if _, payload = readV2Frame(t, conn); int64(binary.BigEndian.Uint64(payload)) != 1<<62 {
+		t.Errorf("Expected max %d, got %d", int64(1<<62), int64(binary.BigEndian.Uint64(payload)))
+	}
+}
+
+func TestVersion2ExportAndImport(t *testing.T) {
+	conn := dialV2(t)
+
+	points := []int64{-1 << 50, 7, 1 << 50, -7}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(1+8*len(points)))
+	frame = append(frame, 'M')
+	for _, v := range points {
+		frame = binary.BigEndian.AppendUint64(frame, uint64(v))
+	}
+	sendMessage(t, conn, frame)
+	if _, payload := readV2Frame(t, conn); binary.BigEndian.Uint32(payload) != 2 {
+		t.Fatalf("Expected 2 points accepted, got %d", binary.BigEndian.Uint32(payload))
+	}
+
+	sendMessage(t, conn, buildV2('X', math.MinInt64, math.MaxInt64))
+	_, payload := readV2Frame(t, conn)
+	var got []int64
+	for len(payload) >= 4 {
+		size := binary.BigEndian.Uint32(payload)
+		if size == 0 {
+			break
+		}
+		if size != 16 {
+			t.Fatalf("Expected 16-byte records, got %d", size)
+		}
+		got = append(got, int64(binary.BigEndian.Uint64(payload[4:12])), int64(binary.BigEndian.Uint64(payload[12:20])))
+		payload = payload[4+size:]
+	}
+	if !slices.Equal(got, points) {
+		t.Errorf("Exported %v, want %v", got, points)
+	}
+}
+
+func TestVersion2RejectsMalformedFrame(t *testing.T) {
+	conn := dialV2(t)
+
+	// An insert with one field
+	sendMessage(t, conn, buildV2('I', 1))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to close, got %v", err)
+	}
+}
+
+func TestUnsupportedVersionDisconnects(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildFrame('V', 3, 0))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the connection to close, got %v", err)
+	}
+}
+
+func TestTimeWeightedAndMovingAverages(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	sendMessage(t, conn, buildInsert(0, 100))
+	sendMessage(t, conn, buildInsert(10, 200))
+	sendMessage(t, conn, buildInsert(40, 50))
+
+	// 100 for 10, 200 for 30 and 50 for 10, in thousandths
+	sendMessage(t, conn, buildFrame('T', 0, 50))
+	if got := readResponse64(t, conn); got != 150000 {
+		t.Errorf("Expected TWAP 150000, got %d", got)
+	}
+
+	frame := append(buildFrame('W', 0, 40), 0, 0, 0, 20)
+	sendMessage(t, conn, frame)
+	count := binary.BigEndian.Uint32(readFrame(t, conn, 4))
+	records := readFrame(t, conn, int(count)*12)
+	want := [][2]int64{{0, 100000}, {10, 150000}, {40, 50000}}
+	if int(count) != len(want) {
+		t.Fatalf("Expected %d records, got %d", len(want), count)
+	}
+	for i, w := range want {
+		r := records[i*12:]
+		got := [2]int64{int64(int32(binary.BigEndian.Uint32(r))), int64(binary.BigEndian.Uint64(r[4:]))}
+		if got != w {
+			t.Errorf("Record %d: expected %v, got %v", i, w, got)
+		}
+	}
+}
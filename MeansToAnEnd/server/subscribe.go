@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"time"
+)
+
+// SubscribeOperation asks for the mean over [minTime, maxTime] of the
+// session's current series to be pushed whenever inserts change it. Its
+// frame is 13 bytes: the opcode, minTime and maxTime as big-endian int32 and
+// the shortest time between pushes in milliseconds as a big-endian uint32.
+//
+// Subscribing switches the connection to tagged mode for good. Everything
+// sent in answer to a frame, including the reply to the subscribe itself, is
+// then preceded by a ReplyFrame byte, and pushes are PushFrame frames, so
+// the two can be told apart on one connection. The reply to a subscribe is
+// the subscription id as a big-endian uint32. A push is the PushFrame byte,
+// the subscription id as a big-endian uint32 and the mean as a big-endian
+// int32; the first push follows the subscribe immediately. In protocol
+// version 2 every frame is tagged and the mean of a push is an int64.
+const (
+	SubscribeOperation   byte = 'U'
+	SubscribeMessageSize int  = 13
+	ReplyFrame           byte = 'R'
+	PushFrame            byte = 'P'
+	PushFrameSize        int  = 9
+
+	// MaxSubscriptions bounds the subscriptions on one connection.
+	MaxSubscriptions = 16
+)
+
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// subscription pushes the mean of a range of one series.
+type subscription struct {
+	id               uint32
+	sr               *series
+	minTime, maxTime int64
+	interval         time.Duration
+	proto            protocol
+	changed          chan struct{}
+	started          bool
+
+	// Pushes that read below the retention horizon are marked as the
+	// policy says, with the offset of the subscribe frame
+	offset        int64
+	horizonPolicy HorizonPolicy
+}
+
+// watch registers changed to be signalled whenever sr changes.
+func (sr *series) watch(changed chan struct{}) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	if sr.watchers == nil {
+		sr.watchers = make(map[chan struct{}]struct{})
+	}
+	sr.watchers[changed] = struct{}{}
+}
+
+func (sr *series) unwatch(changed chan struct{}) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	delete(sr.watchers, changed)
+}
+
+// notify signals every watcher without blocking; a watcher that has not
+// caught up with the last signal gets only one. The caller holds the write
+// lock.
+func (sr *series) notify() {
+	for changed := range sr.watchers {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *PriceServer) processSubscribe(w io.Writer, req request, sess *session) error {
+	if len(sess.subscriptions) >= MaxSubscriptions {
+		return fmt.Errorf("%w: limit is %d", ErrTooManySubscriptions, MaxSubscriptions)
+	}
+
+	minTime, maxTime := s.queryRange(req)
+	interval := time.Duration(min(max(req.args[2], 0), math.MaxInt64/int64(time.Millisecond))) * time.Millisecond
+	sub := &subscription{
+		id:       uint32(len(sess.subscriptions)),
+		sr:       sess.current,
+		minTime:  minTime,
+		maxTime:  maxTime,
+		interval: max(interval, s.minPushInterval),
+		proto:    sess.proto,
+		changed:  make(chan struct{}, 1),
+
+		offset:        sess.offset,
+		horizonPolicy: s.horizonPolicy,
+	}
+	sess.tagged = true
+	sess.subscriptions = append(sess.subscriptions, sub)
+
+	reply := binary.BigEndian.AppendUint32(nil, sub.id)
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+// startPushers starts pushing to the subscriptions that are not pushing yet.
+func (sess *session) startPushers() {
+	for _, sub := range sess.subscriptions {
+		if sub.started {
+			continue
+		}
+		sub.started = true
+
+		// The first push reports the current mean
+		sub.changed <- struct{}{}
+		sub.sr.watch(sub.changed)
+		if sess.done == nil {
+			sess.done = make(chan struct{})
+		}
+		done := sess.done
+		sess.pushers.Add(1)
+		go func() {
+			defer sess.pushers.Done()
+			defer sub.sr.unwatch(sub.changed)
+			if err := sub.push(sess.out, done); err != nil && sess.addr != nil {
+				log.Printf("Stopped pushing to %s: %v", sess.addr, err)
+			}
+		}()
+	}
+}
+
+// push writes the mean to out each time the series changes, at most once
+// per interval, until done is closed. A change that leaves the mean as it
+// was is not pushed. Once the range reaches below the retention horizon,
+// each push is preceded by a NoticeFrame under HorizonPartial, while under
+// HorizonError an error frame takes its place and pushing stops.
+func (sub *subscription) push(out *replyWriter, done <-chan struct{}) error {
+	id := binary.BigEndian.AppendUint32(nil, sub.id)
+
+	var last int64
+	pushed := false
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-sub.changed:
+		}
+
+		var mean int64
+		sub.sr.read(func(prices *priceIndex) {
+			mean = calculateAverage(prices, sub.minTime, sub.maxTime)
+		})
+		if pushed && mean == last {
+			continue
+		}
+
+		// Checked after the read, so a sweep in between marks the push
+		// rather than going unnoticed
+		var frames bytes.Buffer
+		if sub.sr.pastHorizon(sub.minTime) {
+			payload := errorPayload(ErrorRetentionHorizon, sub.offset)
+			if sub.horizonPolicy == HorizonError {
+				if err := writeFrame(out, sub.proto, ErrorFrame, payload); err != nil {
+					return err
+				}
+				return out.Flush()
+			}
+			writeFrame(&frames, sub.proto, NoticeFrame, payload)
+		}
+		writeFrame(&frames, sub.proto, PushFrame, sub.proto.appendValue(id, mean))
+
+		// One write, so that replies cannot come between a notice and its push
+		if _, err := out.Write(frames.Bytes()); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		last, pushed = mean, true
+
+		// Changes during the wait are coalesced into the next push
+		timer := time.NewTimer(sub.interval)
+		select {
+		case <-done:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// unsubscribe stops every push to the session and waits for the pushers to
+// finish writing.
+func (sess *session) unsubscribe() {
+	if sess.done != nil {
+		close(sess.done)
+		sess.pushers.Wait()
+		sess.done = nil
+	}
+}
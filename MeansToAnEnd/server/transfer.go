@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportOperation streams the prices of the session's current series with
+// minTime <= timestamp <= maxTime in timestamp order. The frame has the
+// layout of a query. Each point is sent as a record: its length as a
+// big-endian uint32, PointSize in protocol version 1, then the timestamp and
+// the price as big-endian int32. In version 2 records are V2PointSize long
+// and hold int64s. A record of length zero ends the export. Version 2
+// clients can store values an int32 cannot hold, so a version 1 export that
+// would include one is refused with ErrorValueOutOfRange rather than sent
+// clamped.
+//
+// ImportOperation stores many prices in one frame: the opcode, the number
+// of points as a big-endian uint32 and four zero bytes, followed by that
+// many points of PointSize bytes each. Every point is inserted as if by its
+// own insert frame. The reply is the number of points accepted as a
+// big-endian uint32; an import refused under the reject limit policy stops
+// at the refused point.
+const (
+	ExportOperation byte = 'X'
+	ImportOperation byte = 'M'
+	PointSize       int  = 8
+
+	// MaxImportPoints bounds the points in one import frame.
+	MaxImportPoints = 1 << 16
+
+	// ErrorValueOutOfRange means a version 1 export would have held a
+	// timestamp or price outside the int32 range.
+	ErrorValueOutOfRange ErrorCode = 10
+)
+
+var ErrValueOutOfRange = errors.New("value out of int32 range")
+
+func (s *PriceServer) processExport(w io.Writer, req request, sess *session) error {
+	minTime, maxTime := s.queryRange(req)
+	proto := sess.proto
+	size := proto.pointSize()
+
+	// Copy the points out so a slow reader does not hold up inserts
+	var points []byte
+	var outOfRange *point
+	sess.current.read(func(prices *priceIndex) {
+		prices.Ascend(minTime, maxTime, func(timestamp, price int64) bool {
+			if proto == Version1 && (timestamp != int64(int32(timestamp)) || price != int64(int32(price))) {
+				outOfRange = &point{timestamp, price}
+				return false
+			}
+			points = proto.appendValue(points, timestamp)
+			points = proto.appendValue(points, price)
+			return true
+		})
+	})
+	// Nothing is written yet, so the refusal takes the place of the export
+	if outOfRange != nil {
+		return &limitError{code: ErrorValueOutOfRange, err: fmt.Errorf("%w: price %d at %d", ErrValueOutOfRange, outOfRange.price, outOfRange.timestamp)}
+	}
+
+	record := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+	for i := 0; i < len(points); i += size {
+		copy(record[4:], points[i:i+size])
+		if _, err := w.Write(record); err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+	}
+	if _, err := w.Write(make([]byte, 4)); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
+
+func (s *PriceServer) processImport(w io.Writer, req request, sess *session) error {
+	var accepted uint32
+	for _, p := range req.points {
+		err := sess.current.insert(s.duplicates, p.timestamp, p.price)
+		var refused *limitError
+		if errors.As(err, &refused) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		accepted++
+	}
+
+	reply := binary.BigEndian.AppendUint32(nil, accepted)
+	if _, err := w.Write(reply); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
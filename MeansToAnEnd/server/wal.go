@@ -0,0 +1,512 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A persistent series lives in its own directory holding an optional
+// snapshot and a sequence of write-ahead log segments. Every change is
+// appended to the newest segment before it is applied in memory. Once a
+// segment holds enough records it is closed and the points are copied; then,
+// in the background, they are written to a new snapshot and the segments the
+// snapshot covers are deleted.
+//
+// A log record is the payload length and the CRC-32C of the payload, both
+// big-endian uint32s, followed by the payload: a record kind byte, the
+// timestamp and the price. Records are written with int64 fields; logs from
+// before prices were widened hold int32 fields and are still read.
+const (
+	recordHeaderSize    = 8
+	recordPayloadSize   = 17
+	recordPayloadSizeV1 = 9
+	maxRecordPayload    = 1 << 16
+
+	segmentSuffix   = ".wal"
+	snapshotName    = "snapshot"
+	snapshotMagic   = "MTASNAP2"
+	snapshotMagicV1 = "MTASNAP1"
+)
+
+var ErrCorruptStorage = errors.New("corrupt series storage")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// recordKind is the change a log record makes to a series.
+type recordKind byte
+
+const (
+	// recordNone marks an insert that leaves the series unchanged.
+	recordNone recordKind = 0
+	// recordSet stores a price, replacing a single existing one.
+	recordSet recordKind = 'S'
+	// recordAdd stores a price as a new sample.
+	recordAdd recordKind = 'A'
+	// recordEvict deletes the oldest point; its timestamp and price are zero.
+	recordEvict recordKind = 'E'
+)
+
+func (k recordKind) apply(prices *priceIndex, timestamp, price int64) {
+	switch k {
+	case recordSet:
+		prices.Insert(timestamp, price)
+	case recordAdd:
+		prices.Add(timestamp, price)
+	case recordEvict:
+		prices.DeleteOldest()
+	}
+}
+
+// FsyncPolicy decides when appended log records are flushed to stable
+// storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways syncs after every record, so an acknowledged insert
+	// survives a power failure.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval syncs every log with unsynced records periodically.
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever
+)
+
+var fsyncPolicyNames = map[FsyncPolicy]string{
+	FsyncAlways:   "always",
+	FsyncInterval: "interval",
+	FsyncNever:    "never",
+}
+
+func (p FsyncPolicy) String() string {
+	if name, ok := fsyncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+}
+
+// ParseFsyncPolicy accepts the names printed by String. An empty name
+// selects FsyncInterval.
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	if name == "" {
+		return FsyncInterval, nil
+	}
+	for p, n := range fsyncPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q (want always, interval or never)", name)
+}
+
+// seriesLog is the write-ahead log of one persistent series. Appends and
+// the start of a compaction happen under the series write lock; mutex only
+// guards the open segment against the background syncer, idle closer and
+// snapshot writer.
+type seriesLog struct {
+	dir          string
+	fsync        FsyncPolicy
+	compactAfter int
+
+	mutex      sync.Mutex
+	file       *os.File // nil until the next append while the log is idle
+	segment    uint64
+	records    int
+	dirty      bool
+	lastAppend time.Time
+
+	compacting  bool // a snapshot is being written
+	compactions sync.WaitGroup
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x%s", segment, segmentSuffix))
+}
+
+// openSeriesLog recovers the series stored in dir into prices. Its newest
+// segment is opened by the first append. A partly written record at the end of the
+// newest segment is what a crash mid-append leaves behind, so it is
+// truncated away; damage anywhere else is reported as ErrCorruptStorage.
+func openSeriesLog(dir string, fsync FsyncPolicy, compactAfter int, prices *priceIndex) (*seriesLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	next, err := readSnapshot(dir, prices)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &seriesLog{dir: dir, fsync: fsync, compactAfter: compactAfter, segment: next}
+	for i, segment := range segments {
+		if segment < next {
+			// Left behind by a compaction that stopped before deleting it
+			os.Remove(segmentPath(dir, segment))
+			continue
+		}
+		last := i == len(segments)-1
+		records, err := replaySegment(segmentPath(dir, segment), prices, last)
+		if err != nil {
+			return nil, err
+		}
+		l.segment, l.records = segment, records
+	}
+	return l, nil
+}
+
+func openSegment(dir string, segment uint64) (*os.File, error) {
+	return os.OpenFile(segmentPath(dir, segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentSuffix)
+		if !ok {
+			continue
+		}
+		var segment uint64
+		if _, err := fmt.Sscanf(name, "%x", &segment); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	slices.Sort(segments)
+	return segments, nil
+}
+
+// replaySegment applies the records in the segment at path to prices and
+// returns how many there were. If truncate is set, a damaged tail is cut
+// off instead of being reported.
+func replaySegment(path string, prices *priceIndex, truncate bool) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	records, offset := 0, 0
+	for offset < len(data) {
+		payload, ok := decodeRecord(data[offset:])
+		if !ok {
+			if !truncate {
+				return 0, fmt.Errorf("%w: bad record at offset %d of %s", ErrCorruptStorage, offset, path)
+			}
+			if err := os.Truncate(path, int64(offset)); err != nil {
+				return 0, err
+			}
+			break
+		}
+		var timestamp, price int64
+		switch len(payload) {
+		case recordPayloadSize:
+			timestamp = int64(binary.BigEndian.Uint64(payload[1:9]))
+			price = int64(binary.BigEndian.Uint64(payload[9:17]))
+		case recordPayloadSizeV1:
+			timestamp, price = int32Field(payload[1:5]), int32Field(payload[5:9])
+		default:
+			return 0, fmt.Errorf("%w: record of %d bytes at offset %d of %s", ErrCorruptStorage, len(payload), offset, path)
+		}
+		recordKind(payload[0]).apply(prices, timestamp, price)
+
+		records++
+		offset += recordHeaderSize + len(payload)
+	}
+	return records, nil
+}
+
+// decodeRecord returns the payload of the record at the start of data, or
+// false if the record is incomplete or fails its checksum.
+func decodeRecord(data []byte) ([]byte, bool) {
+	if len(data) < recordHeaderSize {
+		return nil, false
+	}
+	size := binary.BigEndian.Uint32(data[0:4])
+	if size > maxRecordPayload || uint32(len(data)-recordHeaderSize) < size {
+		return nil, false
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+size]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[4:8]) {
+		return nil, false
+	}
+	return payload, true
+}
+
+func encodeRecord(kind recordKind, timestamp, price int64) []byte {
+	payload := []byte{byte(kind)}
+	payload = binary.BigEndian.AppendUint64(payload, uint64(timestamp))
+	payload = binary.BigEndian.AppendUint64(payload, uint64(price))
+
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+// append writes a record to the open segment.
+func (l *seriesLog) append(kind recordKind, timestamp, price int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		file, err := openSegment(l.dir, l.segment)
+		if err != nil {
+			return fmt.Errorf("failed to open log: %w", err)
+		}
+		l.file = file
+	}
+	if _, err := l.file.Write(encodeRecord(kind, timestamp, price)); err != nil {
+		return fmt.Errorf("failed to append to log: %w", err)
+	}
+	l.records++
+	l.lastAppend = time.Now()
+
+	switch l.fsync {
+	case FsyncAlways:
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log: %w", err)
+		}
+	case FsyncInterval:
+		l.dirty = true
+	}
+	return nil
+}
+
+// needsCompaction reports whether the open segment has reached its limit
+// and no compaction is under way.
+func (l *seriesLog) needsCompaction() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.compactAfter > 0 && l.records >= l.compactAfter && !l.compacting
+}
+
+// sync flushes the open segment if it has records that are not yet synced.
+func (l *seriesLog) sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// closeIfIdle syncs and closes the open segment if nothing was appended to
+// it for timeout, so that idle series do not hold file descriptors.
+func (l *seriesLog) closeIfIdle(now time.Time, timeout time.Duration) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil || now.Sub(l.lastAppend) < timeout {
+		return nil
+	}
+	err := l.closeFile()
+	l.file, l.dirty = nil, false
+	return err
+}
+
+// closeFile syncs and closes the open segment. The caller holds mutex.
+func (l *seriesLog) closeFile() error {
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// compact starts a new segment and copies prices, then writes the copy to a
+// snapshot and deletes the segments it covers in the background. The caller
+// must hold the series write lock so that prices matches the closed
+// segments exactly; writers wait only for the copy, not for the disk.
+func (l *seriesLog) compact(prices *priceIndex) error {
+	l.mutex.Lock()
+	next := l.segment + 1
+	file, err := openSegment(l.dir, next)
+	if err == nil && l.file != nil {
+		err = l.file.Sync()
+	}
+	if err == nil {
+		if l.file != nil {
+			l.file.Close()
+		}
+		l.file, l.segment, l.records, l.dirty = file, next, 0, false
+		l.compacting = true
+	} else if file != nil {
+		file.Close()
+	}
+	l.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to start log segment: %w", err)
+	}
+
+	points := make([]point, 0, prices.Len())
+	prices.Ascend(math.MinInt64, math.MaxInt64, func(timestamp, price int64) bool {
+		points = append(points, point{timestamp, price})
+		return true
+	})
+
+	l.compactions.Add(1)
+	go func() {
+		defer l.compactions.Done()
+		// The records are already logged, so a failed compaction only costs
+		// a longer replay on the next start
+		if err := l.finishCompaction(next, points); err != nil {
+			log.Printf("Failed to compact %s: %v", l.dir, err)
+		}
+		l.mutex.Lock()
+		l.compacting = false
+		l.mutex.Unlock()
+	}()
+	return nil
+}
+
+// finishCompaction stores points as the snapshot before segment next and
+// deletes the segments it covers.
+func (l *seriesLog) finishCompaction(next uint64, points []point) error {
+	if err := writeSnapshot(l.dir, next, points); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	segments, err := listSegments(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment < next {
+			os.Remove(segmentPath(l.dir, segment))
+		}
+	}
+	return nil
+}
+
+// close waits for a compaction under way and syncs and closes the open
+// segment.
+func (l *seriesLog) close() error {
+	l.compactions.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.closeFile()
+	l.file = nil
+	return err
+}
+
+// A snapshot holds snapshotMagic, the first segment it does not cover and
+// the number of points as big-endian uint64s, then each point's timestamp
+// and price as big-endian int64s in index order, then the CRC-32C of
+// everything before it. Snapshots with snapshotMagicV1 hold int32 points.
+func writeSnapshot(dir string, next uint64, points []point) error {
+	data := binary.BigEndian.AppendUint64([]byte(snapshotMagic), next)
+	data = binary.BigEndian.AppendUint64(data, uint64(len(points)))
+	for _, p := range points {
+		data = binary.BigEndian.AppendUint64(data, uint64(p.timestamp))
+		data = binary.BigEndian.AppendUint64(data, uint64(p.price))
+	}
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+
+	path := filepath.Join(dir, snapshotName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// readSnapshot loads the snapshot in dir into prices, if there is one, and
+// returns the first segment it does not cover.
+func readSnapshot(dir string, prices *priceIndex) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotName))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	const headerSize = len(snapshotMagic) + 16
+	if len(data) < headerSize+4 {
+		return 0, fmt.Errorf("%w: bad snapshot header in %s", ErrCorruptStorage, dir)
+	}
+	pointSize := V2PointSize
+	switch string(data[:len(snapshotMagic)]) {
+	case snapshotMagic:
+	case snapshotMagicV1:
+		pointSize = PointSize
+	default:
+		return 0, fmt.Errorf("%w: bad snapshot header in %s", ErrCorruptStorage, dir)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return 0, fmt.Errorf("%w: snapshot checksum mismatch in %s", ErrCorruptStorage, dir)
+	}
+
+	next := binary.BigEndian.Uint64(body[8:16])
+	count := binary.BigEndian.Uint64(body[16:24])
+	points := body[headerSize:]
+	if uint64(len(points)) != count*uint64(pointSize) {
+		return 0, fmt.Errorf("%w: snapshot size does not match %d points in %s", ErrCorruptStorage, count, dir)
+	}
+
+	// Adding in index order keeps samples that share a timestamp in order
+	for p := points; len(p) > 0; p = p[pointSize:] {
+		if pointSize == PointSize {
+			prices.Add(int32Field(p[0:4]), int32Field(p[4:8]))
+			continue
+		}
+		prices.Add(int64(binary.BigEndian.Uint64(p[0:8])), int64(binary.BigEndian.Uint64(p[8:16])))
+	}
+	return next, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Some platforms cannot sync a directory; the rename is still atomic
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
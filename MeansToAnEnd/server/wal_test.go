@@ -0,0 +1,394 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bhaski-1234/protohackers/MeansToAnEnd/config"
+)
+
+// openTestSeries opens the persistent series stored in dir.
+func openTestSeries(t *testing.T, dir string, compactAfter int) *series {
+	t.Helper()
+	sr := newSeries("test")
+	l, err := openSeriesLog(dir, FsyncNever, compactAfter, sr.prices)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	sr.log = l
+	t.Cleanup(func() { l.close() })
+	return sr
+}
+
+func collect(sr *series) [][2]int64 {
+	var points [][2]int64
+	sr.read(func(prices *priceIndex) {
+		prices.Ascend(math.MinInt64, math.MaxInt64, func(timestamp, price int64) bool {
+			points = append(points, [2]int64{timestamp, price})
+			return true
+		})
+	})
+	return points
+}
+
+func TestLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	sr := openTestSeries(t, dir, 0)
+	sr.insert(DuplicateOverwrite, 1000, 100)
+	sr.insert(DuplicateOverwrite, 1000, 150)
+	sr.insert(DuplicateAccumulate, 1000, 300)
+	sr.insert(DuplicateKeepFirst, 2000, -5)
+	sr.insert(DuplicateKeepFirst, 2000, 7)
+	want := collect(sr)
+	sr.log.close()
+
+	recovered := openTestSeries(t, dir, 0)
+	if got := collect(recovered); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+	if recovered.log.records != 4 {
+		t.Errorf("Expected 4 records, got %d", recovered.log.records)
+	}
+}
+
+func TestLogTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	sr := openTestSeries(t, dir, 0)
+	sr.insert(DuplicateOverwrite, 1000, 100)
+	sr.insert(DuplicateOverwrite, 2000, 200)
+	sr.log.close()
+
+	// A crash part way through appending the third record
+	path := segmentPath(dir, 0)
+	torn := encodeRecord(recordSet, 3000, 300)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(torn[:len(torn)-3])
+	f.Close()
+
+	recovered := openTestSeries(t, dir, 0)
+	want := [][2]int64{{1000, 100}, {2000, 200}}
+	if got := collect(recovered); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+
+	// Appends continue after the truncated tail
+	recovered.insert(DuplicateOverwrite, 3000, 300)
+	recovered.log.close()
+	want = append(want, [2]int64{3000, 300})
+	if got := collect(openTestSeries(t, dir, 0)); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v after append, want %v", got, want)
+	}
+}
+
+func TestLogTruncatesBadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	sr := openTestSeries(t, dir, 0)
+	sr.insert(DuplicateOverwrite, 1000, 100)
+	sr.insert(DuplicateOverwrite, 2000, 200)
+	sr.log.close()
+
+	path := segmentPath(dir, 0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	want := [][2]int64{{1000, 100}}
+	if got := collect(openTestSeries(t, dir, 0)); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+}
+
+func TestLogCompaction(t *testing.T) {
+	dir := t.TempDir()
+	sr := openTestSeries(t, dir, 3)
+	for i := int64(0); i < 10; i++ {
+		sr.insert(DuplicateAccumulate, i%4, i)
+		// One snapshot at a time, as each compaction is started only once
+		// the last is written
+		sr.log.compactions.Wait()
+	}
+	want := collect(sr)
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0] != 3 {
+		t.Errorf("Expected only segment 3 after compaction, got %v", segments)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotName)); err != nil {
+		t.Errorf("Expected a snapshot: %v", err)
+	}
+	sr.log.close()
+
+	recovered := openTestSeries(t, dir, 3)
+	if got := collect(recovered); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+	if recovered.log.segment != 3 || recovered.log.records != 1 {
+		t.Errorf("Expected segment 3 with 1 record, got segment %d with %d", recovered.log.segment, recovered.log.records)
+	}
+}
+
+func TestCompactionRunsAlongsideInserts(t *testing.T) {
+	dir := t.TempDir()
+	sr := openTestSeries(t, dir, 50)
+
+	// Readers and writers keep going while snapshots are written
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int64(0); i < 500; i++ {
+				sr.insert(DuplicateAccumulate, w*1000+i, i)
+				sr.read(func(prices *priceIndex) { prices.Aggregate(0, math.MaxInt64) })
+			}
+		}()
+	}
+	wg.Wait()
+	want := collect(sr)
+	sr.log.close()
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotName)); err != nil {
+		t.Errorf("Expected a snapshot: %v", err)
+	}
+	if got := collect(openTestSeries(t, dir, 50)); !slices.Equal(got, want) {
+		t.Errorf("Recovered %d points, want %d", len(got), len(want))
+	}
+}
+
+func TestCorruptOlderSegmentIsReported(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(segmentPath(dir, 0), []byte{0, 0, 0, 9, 1, 2}, 0o644)
+	os.WriteFile(segmentPath(dir, 1), nil, 0o644)
+
+	if _, err := openSeriesLog(dir, FsyncNever, 0, newPriceIndex()); !errors.Is(err, ErrCorruptStorage) {
+		t.Errorf("Expected ErrCorruptStorage, got %v", err)
+	}
+}
+
+func TestSeriesStoreRecoversNamedSeries(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openSeriesStore(dir, FsyncAlways, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := st.get("btc/usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.insert(DuplicateOverwrite, 1, 42)
+	st.close()
+
+	st, err = openSeriesStore(dir, FsyncAlways, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if len(st.series) != 1 {
+		t.Fatalf("Expected 1 recovered series, got %d", len(st.series))
+	}
+	if got := collect(st.series["btc/usd"]); !slices.Equal(got, [][2]int64{{1, 42}}) {
+		t.Errorf("Recovered %v", got)
+	}
+}
+
+func TestIdleLogIsClosedAndReopened(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openSeriesStore(dir, FsyncNever, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := st.get("idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr.insert(DuplicateOverwrite, 1, 10)
+
+	isOpen := func() bool {
+		sr.log.mutex.Lock()
+		defer sr.log.mutex.Unlock()
+		return sr.log.file != nil
+	}
+	if !isOpen() {
+		t.Fatal("Expected the log to be open after a write")
+	}
+	st.closeIdleLogs(10 * time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); isOpen(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Idle log was not closed")
+		}
+	}
+
+	if err := sr.insert(DuplicateOverwrite, 2, 20); err != nil {
+		t.Fatalf("Insert after the log was closed failed: %v", err)
+	}
+	st.close()
+
+	st, err = openSeriesStore(dir, FsyncNever, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if got := collect(st.series["idle"]); !slices.Equal(got, [][2]int64{{1, 10}, {2, 20}}) {
+		t.Errorf("Recovered %v", got)
+	}
+}
+
+func TestSeriesStoreLimitsPersistentNames(t *testing.T) {
+	st, err := openSeriesStore(t.TempDir(), FsyncNever, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+
+	longest := strings.Repeat("x", MaxPersistentSeriesName)
+	sr, err := st.get(longest)
+	if err != nil {
+		t.Fatalf("Name of %d bytes refused: %v", len(longest), err)
+	}
+	if err := sr.insert(DuplicateOverwrite, 1, 42); err != nil {
+		t.Errorf("Insert into series with longest name failed: %v", err)
+	}
+
+	if _, err := st.get(longest + "x"); !errors.Is(err, ErrSeriesNameTooLong) {
+		t.Errorf("Expected ErrSeriesNameTooLong, got %v", err)
+	}
+	if code, ok := protocolErrorCode(ErrSeriesNameTooLong); !ok || code != ErrorInvalidRequest {
+		t.Errorf("Expected code %d for a long name, got %d", ErrorInvalidRequest, code)
+	}
+}
+
+func TestStopClosesConnectionsAndLogs(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openSeriesStore(dir, FsyncInterval, time.Hour, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &PriceServer{listener: listener, conns: make(map[net.Conn]struct{}), store: st}
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		s.Start()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	attach := append(binary.BigEndian.AppendUint32([]byte{AttachOperation}, 4), 0, 0, 0, 0)
+	conn.Write(append(attach, "feed"...))
+	io.ReadFull(conn, make([]byte, 8))
+	conn.Write(message(InsertOperation, 1, 42))
+	// The query's reply shows the insert was handled
+	conn.Write(message(QueryOperation, 0, 10))
+	io.ReadFull(conn, make([]byte, 4))
+
+	// The client stays connected, so Stop has to close its connection
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Stop failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return with a client connected")
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+
+	st, err = openSeriesStore(dir, FsyncNever, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	if got := collect(st.series["feed"]); !slices.Equal(got, [][2]int64{{1, 42}}) {
+		t.Errorf("Recovered %v after Stop", got)
+	}
+}
+
+func TestNewServerRejectsNonPositiveFsyncInterval(t *testing.T) {
+	dataDir, fsync, interval := config.DataDir, config.Fsync, config.FsyncInterval
+	t.Cleanup(func() {
+		config.DataDir, config.Fsync, config.FsyncInterval = dataDir, fsync, interval
+	})
+
+	config.DataDir, config.Fsync = t.TempDir(), "interval"
+	for _, interval := range []time.Duration{0, -time.Second} {
+		config.FsyncInterval = interval
+		if s, err := NewServer(); err == nil {
+			s.Stop()
+			t.Errorf("Expected an error for fsync interval %v", interval)
+		}
+	}
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for p, name := range fsyncPolicyNames {
+		if got, err := ParseFsyncPolicy(name); err != nil || got != p {
+			t.Errorf("ParseFsyncPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if got, err := ParseFsyncPolicy(""); err != nil || got != FsyncInterval {
+		t.Errorf("Expected interval by default, got %v, %v", got, err)
+	}
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestLogReadsInt32Storage(t *testing.T) {
+	dir := t.TempDir()
+
+	// A snapshot and a segment written before prices were widened
+	snapshot := binary.BigEndian.AppendUint64([]byte(snapshotMagicV1), 1)
+	snapshot = binary.BigEndian.AppendUint64(snapshot, 1)
+	snapshot = binary.BigEndian.AppendUint32(snapshot, uint32(5))
+	snapshot = binary.BigEndian.AppendUint32(snapshot, math.MaxUint32) // -1
+	snapshot = binary.BigEndian.AppendUint32(snapshot, crc32.Checksum(snapshot, crcTable))
+	os.WriteFile(filepath.Join(dir, snapshotName), snapshot, 0o644)
+
+	payload := []byte{byte(recordAdd), 0, 0, 0, 6, 0, 0, 0, 60}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(payload, crcTable))
+	os.WriteFile(segmentPath(dir, 1), append(record, payload...), 0o644)
+
+	sr := openTestSeries(t, dir, 0)
+	sr.insert(DuplicateOverwrite, 1<<40, 1<<50)
+	sr.log.close()
+
+	want := [][2]int64{{5, -1}, {6, 60}, {1 << 40, 1 << 50}}
+	if got := collect(openTestSeries(t, dir, 0)); !slices.Equal(got, want) {
+		t.Errorf("Recovered %v, want %v", got, want)
+	}
+}
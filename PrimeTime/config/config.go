@@ -2,3 +2,28 @@ package config
 
 var Host string
 var Port int
+
+// SieveLimit is the largest number covered by the precomputed sieve. Zero
+// disables the sieve.
+var SieveLimit uint64
+
+// SieveFile is where the sieve is stored between restarts.
+var SieveFile string
+
+// UDP enables the datagram listener on the same host and port.
+var UDP bool
+
+// MaxDatagramSize is the largest UDP request accepted, in bytes.
+var MaxDatagramSize int
+
+// UDPRate and UDPBurst set the per-source datagram rate limit.
+var UDPRate float64
+var UDPBurst float64
+
+// Cost budgets, in units of roughly one 64-bit primality test, refilled per
+// second up to the burst. IP budgets are shared by all of a client's
+// connections and datagrams.
+var IPCostRate float64
+var IPCostBurst float64
+var ConnCostRate float64
+var ConnCostBurst float64
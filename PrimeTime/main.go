@@ -2,16 +2,41 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/bhaski-1234/protohackers/PrimeTime/config"
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
 	"github.com/bhaski-1234/protohackers/PrimeTime/server"
+	"strconv"
 )
 
 func getFlags() {
 	flag.StringVar(&config.Host, "host", "0.0.0.0", "Host for the application")
 	flag.IntVar(&config.Port, "port", 9000, "Port for the application")
+	flag.Func("sieve-limit", fmt.Sprintf("Precompute primes up to this bound, at most %d (0, the default, disables the sieve)", uint64(numtheory.MaxSieveLimit)), parseSieveLimit)
+	flag.StringVar(&config.SieveFile, "sieve-file", "primes.sieve", "File the sieve is stored in and mapped from")
+	flag.BoolVar(&config.UDP, "udp", false, "Also accept requests over UDP")
+	flag.IntVar(&config.MaxDatagramSize, "udp-max-size", 8192, "Largest UDP request accepted, in bytes")
+	flag.Float64Var(&config.UDPRate, "udp-rate", 100, "Datagrams per second allowed from each source")
+	flag.Float64Var(&config.UDPBurst, "udp-burst", 200, "Datagram burst allowed from each source")
+	flag.Float64Var(&config.IPCostRate, "ip-cost-rate", 100000, "Cost units per second allowed for each client IP")
+	flag.Float64Var(&config.IPCostBurst, "ip-cost-burst", 1000000, "Cost units a client IP may spend in a burst")
+	flag.Float64Var(&config.ConnCostRate, "conn-cost-rate", 50000, "Cost units per second allowed for each connection")
+	flag.Float64Var(&config.ConnCostBurst, "conn-cost-burst", 500000, "Cost units a connection may spend in a burst")
 	flag.Parse()
 }
 
+func parseSieveLimit(value string) error {
+	limit, err := strconv.ParseUint(value, 0, 64)
+	if err != nil {
+		return err
+	}
+	if limit > numtheory.MaxSieveLimit {
+		return fmt.Errorf("%w: %d exceeds %d", numtheory.ErrSieveTooLarge, limit, uint64(numtheory.MaxSieveLimit))
+	}
+	config.SieveLimit = limit
+	return nil
+}
+
 func main() {
 	getFlags()
 	server.RunServer()
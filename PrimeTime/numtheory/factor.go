@@ -0,0 +1,145 @@
+package numtheory
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+)
+
+var ErrNotPositive = errors.New("number must be positive")
+
+// Factor is a prime power appearing in a factorization.
+type Factor struct {
+	Prime    *big.Int
+	Exponent int
+}
+
+// smallPrimes holds every prime below 1000 and is used for trial division
+// before falling back to Pollard's rho.
+var smallPrimes = sievePrimes(1000)
+
+func sievePrimes(limit int) []uint64 {
+	composite := make([]bool, limit)
+	var primes []uint64
+	for i := 2; i < limit; i++ {
+		if composite[i] {
+			continue
+		}
+		primes = append(primes, uint64(i))
+		for j := i * i; j < limit; j += i {
+			composite[j] = true
+		}
+	}
+	return primes
+}
+
+// Factorize returns the prime factorization of n in ascending order of
+// prime. Factorize(1) returns an empty slice.
+func Factorize(n *big.Int) ([]Factor, error) {
+	if n.Sign() <= 0 {
+		return nil, ErrNotPositive
+	}
+
+	counts := make(map[string]*Factor)
+	rest := new(big.Int).Set(n)
+	mod := new(big.Int)
+
+	for _, p := range smallPrimes {
+		bp := new(big.Int).SetUint64(p)
+		for {
+			q, r := new(big.Int).QuoRem(rest, bp, mod)
+			if r.Sign() != 0 {
+				break
+			}
+			addFactor(counts, bp)
+			rest = q
+		}
+	}
+
+	var pending []*big.Int
+	if rest.Cmp(big.NewInt(1)) > 0 {
+		pending = append(pending, rest)
+	}
+	for len(pending) > 0 {
+		m := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if IsPrime(m) {
+			addFactor(counts, m)
+			continue
+		}
+		d := pollardBrent(m)
+		pending = append(pending, d, new(big.Int).Quo(m, d))
+	}
+
+	factors := make([]Factor, 0, len(counts))
+	for _, f := range counts {
+		factors = append(factors, *f)
+	}
+	sort.Slice(factors, func(i, j int) bool {
+		return factors[i].Prime.Cmp(factors[j].Prime) < 0
+	})
+	return factors, nil
+}
+
+func addFactor(counts map[string]*Factor, p *big.Int) {
+	key := p.String()
+	if f, ok := counts[key]; ok {
+		f.Exponent++
+		return
+	}
+	counts[key] = &Factor{Prime: new(big.Int).Set(p), Exponent: 1}
+}
+
+// pollardBrent returns a non-trivial divisor of the composite n using
+// Brent's variant of Pollard's rho.
+func pollardBrent(n *big.Int) *big.Int {
+	one := big.NewInt(1)
+	for c := int64(1); ; c++ {
+		bc := big.NewInt(c)
+		f := func(x *big.Int) *big.Int {
+			x.Mul(x, x)
+			x.Add(x, bc)
+			return x.Mod(x, n)
+		}
+
+		y := big.NewInt(2)
+		x := new(big.Int)
+		ys := new(big.Int)
+		q := big.NewInt(1)
+		g := big.NewInt(1)
+		diff := new(big.Int)
+		const batch = 128
+
+		for r := 1; g.Cmp(one) == 0; r *= 2 {
+			x.Set(y)
+			for i := 0; i < r; i++ {
+				f(y)
+			}
+			for k := 0; k < r && g.Cmp(one) == 0; k += batch {
+				ys.Set(y)
+				for i := 0; i < batch && i < r-k; i++ {
+					f(y)
+					diff.Sub(x, y)
+					q.Mul(q, diff.Abs(diff))
+					q.Mod(q, n)
+				}
+				g.GCD(nil, nil, q, n)
+			}
+		}
+
+		if g.Cmp(n) == 0 {
+			// The batched product overshot; step through one at a time.
+			for {
+				f(ys)
+				diff.Sub(x, ys)
+				g.GCD(nil, nil, diff.Abs(diff), n)
+				if g.Cmp(one) > 0 {
+					break
+				}
+			}
+		}
+		if g.Cmp(n) != 0 {
+			return g
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package numtheory
+
+import (
+	"errors"
+	"math/big"
+)
+
+var (
+	ErrZeroModulus = errors.New("modulus must be non-zero")
+	ErrNoInverse   = errors.New("no modular inverse exists")
+	ErrEvenModulus = errors.New("modulus must be a positive odd integer")
+)
+
+// ModPow returns base^exp mod |m| in the range [0, |m|). A negative
+// exponent is allowed when base is invertible modulo m.
+func ModPow(base, exp, m *big.Int) (*big.Int, error) {
+	if m.Sign() == 0 {
+		return nil, ErrZeroModulus
+	}
+	mod := new(big.Int).Abs(m)
+
+	b := new(big.Int).Mod(base, mod)
+	e := exp
+	if exp.Sign() < 0 {
+		inv, err := ModInverse(b, mod)
+		if err != nil {
+			return nil, err
+		}
+		b = inv
+		e = new(big.Int).Neg(exp)
+	}
+	return new(big.Int).Exp(b, e, mod), nil
+}
+
+// ModInverse returns the x in [0, |m|) with a*x = 1 mod m.
+func ModInverse(a, m *big.Int) (*big.Int, error) {
+	if m.Sign() == 0 {
+		return nil, ErrZeroModulus
+	}
+	mod := new(big.Int).Abs(m)
+	if mod.Cmp(big.NewInt(1)) == 0 {
+		return new(big.Int), nil
+	}
+
+	x := new(big.Int).ModInverse(new(big.Int).Mod(a, mod), mod)
+	if x == nil {
+		return nil, ErrNoInverse
+	}
+	return x, nil
+}
+
+// GCD returns the non-negative greatest common divisor of a and b.
+func GCD(a, b *big.Int) *big.Int {
+	return new(big.Int).GCD(nil, nil, new(big.Int).Abs(a), new(big.Int).Abs(b))
+}
+
+// LCM returns the non-negative least common multiple of a and b. It is zero
+// if either argument is zero.
+func LCM(a, b *big.Int) *big.Int {
+	if a.Sign() == 0 || b.Sign() == 0 {
+		return new(big.Int)
+	}
+	l := new(big.Int).Quo(new(big.Int).Abs(a), GCD(a, b))
+	return l.Mul(l, new(big.Int).Abs(b))
+}
+
+// Totient returns Euler's totient of n, the count of integers in [1, n]
+// that are coprime to n. It factorizes n, so its cost grows with the size of
+// n's second largest prime factor.
+func Totient(n *big.Int) (*big.Int, error) {
+	factors, err := Factorize(n)
+	if err != nil {
+		return nil, err
+	}
+
+	phi := big.NewInt(1)
+	one := big.NewInt(1)
+	for _, f := range factors {
+		// p^k - p^(k-1) = p^(k-1) * (p - 1)
+		phi.Mul(phi, new(big.Int).Sub(f.Prime, one))
+		for i := 1; i < f.Exponent; i++ {
+			phi.Mul(phi, f.Prime)
+		}
+	}
+	return phi, nil
+}
+
+// Jacobi returns the Jacobi symbol (a/n), which is -1, 0 or 1. n must be a
+// positive odd integer.
+func Jacobi(a, n *big.Int) (int, error) {
+	if n.Sign() <= 0 || n.Bit(0) == 0 {
+		return 0, ErrEvenModulus
+	}
+	return big.Jacobi(a, n), nil
+}
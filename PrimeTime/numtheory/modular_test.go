@@ -0,0 +1,133 @@
+package numtheory_test
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
+)
+
+func TestModPow(t *testing.T) {
+	cases := []struct {
+		base, exp, mod string
+		want           string
+		err            error
+	}{
+		{"4", "13", "497", "445", nil},
+		{"-4", "3", "7", "6", nil},
+		{"3", "-1", "11", "4", nil},
+		{"3", "-2", "-11", "5", nil},
+		{"5", "0", "1", "0", nil},
+		{"2", "3", "0", "", numtheory.ErrZeroModulus},
+		{"2", "-1", "4", "", numtheory.ErrNoInverse},
+	}
+	for _, c := range cases {
+		got, err := numtheory.ModPow(mustBig(t, c.base), mustBig(t, c.exp), mustBig(t, c.mod))
+		if !errors.Is(err, c.err) {
+			t.Errorf("ModPow(%s, %s, %s) error = %v, want %v", c.base, c.exp, c.mod, err, c.err)
+			continue
+		}
+		if err == nil && got.String() != c.want {
+			t.Errorf("ModPow(%s, %s, %s) = %s, want %s", c.base, c.exp, c.mod, got, c.want)
+		}
+	}
+}
+
+func TestModInverse(t *testing.T) {
+	cases := []struct {
+		a, mod string
+		want   string
+		err    error
+	}{
+		{"3", "11", "4", nil},
+		{"-3", "11", "7", nil},
+		{"10", "17", "12", nil},
+		{"7", "1", "0", nil},
+		{"6", "9", "", numtheory.ErrNoInverse},
+		{"6", "0", "", numtheory.ErrZeroModulus},
+	}
+	for _, c := range cases {
+		got, err := numtheory.ModInverse(mustBig(t, c.a), mustBig(t, c.mod))
+		if !errors.Is(err, c.err) {
+			t.Errorf("ModInverse(%s, %s) error = %v, want %v", c.a, c.mod, err, c.err)
+			continue
+		}
+		if err == nil && got.String() != c.want {
+			t.Errorf("ModInverse(%s, %s) = %s, want %s", c.a, c.mod, got, c.want)
+		}
+	}
+}
+
+func TestGCDAndLCM(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		gcd, lcm string
+	}{
+		{"12", "18", "6", "36"},
+		{"-12", "18", "6", "36"},
+		{"0", "5", "5", "0"},
+		{"0", "0", "0", "0"},
+		{"1000000007", "1000000009", "1", "1000000016000000063"},
+	}
+	for _, c := range cases {
+		a, b := mustBig(t, c.a), mustBig(t, c.b)
+		if got := numtheory.GCD(a, b); got.String() != c.gcd {
+			t.Errorf("GCD(%s, %s) = %s, want %s", c.a, c.b, got, c.gcd)
+		}
+		if got := numtheory.LCM(a, b); got.String() != c.lcm {
+			t.Errorf("LCM(%s, %s) = %s, want %s", c.a, c.b, got, c.lcm)
+		}
+	}
+}
+
+func TestTotient(t *testing.T) {
+	cases := map[string]string{
+		"1":                   "1",
+		"9":                   "6",
+		"36":                  "12",
+		"97":                  "96",
+		"1000000016000000063": "1000000014000000048",
+	}
+	for n, want := range cases {
+		got, err := numtheory.Totient(mustBig(t, n))
+		if err != nil {
+			t.Fatalf("Totient(%s) returned error: %v", n, err)
+		}
+		if got.String() != want {
+			t.Errorf("Totient(%s) = %s, want %s", n, got, want)
+		}
+	}
+
+	if _, err := numtheory.Totient(big.NewInt(-4)); !errors.Is(err, numtheory.ErrNotPositive) {
+		t.Errorf("Expected ErrNotPositive for -4, got %v", err)
+	}
+}
+
+func TestJacobi(t *testing.T) {
+	cases := []struct {
+		a, n string
+		want int
+	}{
+		{"1001", "9907", -1},
+		{"19", "45", 1},
+		{"8", "21", -1},
+		{"5", "21", 1},
+		{"3", "9", 0},
+	}
+	for _, c := range cases {
+		got, err := numtheory.Jacobi(mustBig(t, c.a), mustBig(t, c.n))
+		if err != nil {
+			t.Fatalf("Jacobi(%s, %s) returned error: %v", c.a, c.n, err)
+		}
+		if got != c.want {
+			t.Errorf("Jacobi(%s, %s) = %d, want %d", c.a, c.n, got, c.want)
+		}
+	}
+
+	for _, n := range []string{"0", "8", "-7"} {
+		if _, err := numtheory.Jacobi(big.NewInt(3), mustBig(t, n)); !errors.Is(err, numtheory.ErrEvenModulus) {
+			t.Errorf("Jacobi(3, %s) error = %v, want ErrEvenModulus", n, err)
+		}
+	}
+}
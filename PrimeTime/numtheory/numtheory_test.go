@@ -0,0 +1,165 @@
+package numtheory_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
+)
+
+func mustBig(t testing.TB, s string) *big.Int {
+	t.Helper()
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		t.Fatalf("Invalid test number %q", s)
+	}
+	return n
+}
+
+func TestIsPrime(t *testing.T) {
+	cases := map[string]bool{
+		"-7":                   false,
+		"0":                    false,
+		"1":                    false,
+		"2":                    true,
+		"9":                    false,
+		"97":                   true,
+		"561":                  false, // Carmichael number
+		"4294967291":           true,
+		"18446744073709551557": true, // largest prime below 2^64
+		"18446744073709551615": false,
+		"170141183460469231731687303715884105727": true, // 2^127 - 1
+		"170141183460469231731687303715884105729": false,
+	}
+	for s, want := range cases {
+		if got := numtheory.IsPrime(mustBig(t, s)); got != want {
+			t.Errorf("IsPrime(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestIsPrimeNumber(t *testing.T) {
+	cases := map[json.Number]bool{
+		"7":     true,
+		"7.0":   true,
+		"0.7e1": true,
+		"7.5":   false,
+		"1e400": false,
+		"-3":    false,
+		"abc":   false,
+	}
+	for num, want := range cases {
+		if got := numtheory.IsPrimeNumber(num); got != want {
+			t.Errorf("IsPrimeNumber(%s) = %v, want %v", num, got, want)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	cases := []struct {
+		in   json.Number
+		want string
+		err  error
+	}{
+		{"42", "42", nil},
+		{"-42", "-42", nil},
+		{"42.000", "42", nil},
+		{"4.2e1", "42", nil},
+		{"4200E-2", "42", nil},
+		{"1e+3", "1000", nil},
+		{"0.0", "0", nil},
+		{"4.25", "", numtheory.ErrNotInteger},
+		{"1e-1", "", numtheory.ErrNotInteger},
+		{"1e5000", "", numtheory.ErrTooLarge},
+		{"1e99999999999999999999", "", numtheory.ErrTooLarge},
+		{"", "", numtheory.ErrNotNumber},
+		{"1.2.3", "", numtheory.ErrNotNumber},
+		{"0x10", "", numtheory.ErrNotNumber},
+	}
+	for _, c := range cases {
+		n, err := numtheory.ParseNumber(c.in)
+		if !errors.Is(err, c.err) {
+			t.Errorf("ParseNumber(%q) error = %v, want %v", c.in, err, c.err)
+			continue
+		}
+		if err == nil && n.String() != c.want {
+			t.Errorf("ParseNumber(%q) = %s, want %s", c.in, n, c.want)
+		}
+	}
+}
+
+func TestFactorize(t *testing.T) {
+	cases := map[string]string{
+		"1":                    "",
+		"2":                    "2",
+		"360":                  "2^3 3^2 5",
+		"1000003":              "1000003",
+		"1000006000009":        "1000003^2",
+		"18446744073709551615": "3 5 17 257 641 65537 6700417",
+		"1000000016000000063":  "1000000007 1000000009",
+	}
+	for s, want := range cases {
+		factors, err := numtheory.Factorize(mustBig(t, s))
+		if err != nil {
+			t.Fatalf("Factorize(%s) returned error: %v", s, err)
+		}
+		if got := formatFactors(factors); got != want {
+			t.Errorf("Factorize(%s) = %q, want %q", s, got, want)
+		}
+	}
+
+	if _, err := numtheory.Factorize(big.NewInt(0)); !errors.Is(err, numtheory.ErrNotPositive) {
+		t.Errorf("Expected ErrNotPositive for 0, got %v", err)
+	}
+}
+
+func formatFactors(factors []numtheory.Factor) string {
+	s := ""
+	for i, f := range factors {
+		if i > 0 {
+			s += " "
+		}
+		s += f.Prime.String()
+		if f.Exponent > 1 {
+			s += "^" + big.NewInt(int64(f.Exponent)).String()
+		}
+	}
+	return s
+}
+
+func BenchmarkIsPrimeSmall(b *testing.B) {
+	n := big.NewInt(1000003)
+	for i := 0; i < b.N; i++ {
+		numtheory.IsPrime(n)
+	}
+}
+
+func BenchmarkIsPrime64(b *testing.B) {
+	n := mustBig(b, "18446744073709551557")
+	for i := 0; i < b.N; i++ {
+		numtheory.IsPrime(n)
+	}
+}
+
+func BenchmarkIsPrimeMersenne521(b *testing.B) {
+	n := new(big.Int).Lsh(big.NewInt(1), 521)
+	n.Sub(n, big.NewInt(1))
+	for i := 0; i < b.N; i++ {
+		numtheory.IsPrime(n)
+	}
+}
+
+func BenchmarkParseNumber(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		numtheory.ParseNumber("1.23456789e20")
+	}
+}
+
+func BenchmarkFactorizeSemiprime(b *testing.B) {
+	n := mustBig(b, "1000000016000000063") // 1000000007 * 1000000009
+	for i := 0; i < b.N; i++ {
+		numtheory.Factorize(n)
+	}
+}
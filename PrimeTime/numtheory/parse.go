@@ -0,0 +1,90 @@
+package numtheory
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// MaxExponent bounds the decimal exponent accepted by ParseNumber so that
+// inputs such as 1e999999999 cannot force a huge allocation.
+const MaxExponent = 4096
+
+var (
+	ErrNotNumber  = errors.New("not a valid number")
+	ErrNotInteger = errors.New("not an integer")
+	ErrTooLarge   = errors.New("number too large")
+)
+
+// ParseNumber converts a JSON number into an exact integer. Decimal and
+// exponent forms are accepted as long as they denote a whole number, so
+// "7", "7.0" and "0.7e1" all parse to 7.
+func ParseNumber(num json.Number) (*big.Int, error) {
+	s := string(num)
+	if n, ok := new(big.Int).SetString(s, 10); ok {
+		return n, nil
+	}
+
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	}
+
+	mantissa, exp := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa = s[:i]
+		e, err := strconv.ParseInt(strings.TrimPrefix(s[i+1:], "+"), 10, 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return nil, ErrTooLarge
+			}
+			return nil, ErrNotNumber
+		}
+		exp = e
+	}
+
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return nil, ErrNotNumber
+	}
+
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		return new(big.Int), nil
+	}
+	exp -= int64(len(fracPart))
+
+	// Trailing zeros can absorb a negative exponent without changing the value.
+	for exp < 0 && strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	if exp < 0 {
+		return nil, ErrNotInteger
+	}
+	if exp > MaxExponent {
+		return nil, ErrTooLarge
+	}
+
+	n, _ := new(big.Int).SetString(digits, 10)
+	if exp > 0 {
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil)
+		n.Mul(n, scale)
+	}
+	if negative {
+		n.Neg(n)
+	}
+	return n, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+// Package numtheory provides the number theory behind the PrimeTime server:
+// primality testing, factorization, modular arithmetic and exact parsing of
+// JSON numbers.
+package numtheory
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/bits"
+)
+
+// probablePrimeRounds is the number of Miller-Rabin rounds used on top of the
+// Baillie-PSW test for inputs that do not fit in 64 bits.
+const probablePrimeRounds = 20
+
+// IsPrime reports whether n is prime. The answer is exact for n < 2^64 and
+// has an error probability below 4^-20 above that.
+func IsPrime(n *big.Int) bool {
+	if n.Sign() <= 0 {
+		return false
+	}
+	if n.IsUint64() {
+		return IsPrimeUint64(n.Uint64())
+	}
+	return n.ProbablyPrime(probablePrimeRounds)
+}
+
+// IsPrimeUint64 reports whether n is prime.
+func IsPrimeUint64(n uint64) bool {
+	if n < 2 {
+		return false
+	}
+	for _, p := range smallPrimes[:12] {
+		if n == p {
+			return true
+		}
+		if n%p == 0 {
+			return false
+		}
+	}
+	if n < 37*37 {
+		return true
+	}
+
+	// Miller-Rabin with the first twelve prime bases is deterministic below 2^64.
+	d, s := n-1, 0
+	for d%2 == 0 {
+		d /= 2
+		s++
+	}
+	for _, a := range smallPrimes[:12] {
+		x := powMod(a, d, n)
+		if x == 1 || x == n-1 {
+			continue
+		}
+		composite := true
+		for i := 1; i < s; i++ {
+			x = mulMod(x, x, n)
+			if x == n-1 {
+				composite = false
+				break
+			}
+		}
+		if composite {
+			return false
+		}
+	}
+	return true
+}
+
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, rem := bits.Div64(hi, lo, m)
+	return rem
+}
+
+func powMod(base, exp, m uint64) uint64 {
+	result := uint64(1)
+	base %= m
+	for exp > 0 {
+		if exp&1 == 1 {
+			result = mulMod(result, base, m)
+		}
+		base = mulMod(base, base, m)
+		exp >>= 1
+	}
+	return result
+}
+
+// IsPrimeNumber reports whether num is a prime integer. Numbers that are
+// not integers, or cannot be parsed, are never prime.
+func IsPrimeNumber(num json.Number) bool {
+	n, err := ParseNumber(num)
+	if err != nil {
+		return false
+	}
+	return IsPrime(n)
+}
@@ -0,0 +1,166 @@
+package numtheory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// sieveMagic identifies a sieve file. It is followed by the limit as a
+// big-endian uint64 and then the bitmap.
+const (
+	sieveMagic      = "PTSIEVE1"
+	sieveHeaderSize = 16
+)
+
+// MaxSieveLimit is the largest limit LoadOrBuildSieve accepts, which takes a
+// 4 GB bitmap.
+const MaxSieveLimit = 1 << 36
+
+var (
+	ErrBadSieveFile  = errors.New("invalid sieve file")
+	ErrSieveTooLarge = errors.New("sieve limit too large")
+)
+
+// Sieve is an odd-only bitmap of the composite numbers up to a limit. Bit i
+// stands for the odd number 2i+1, so a limit of 4e9 fits in 250 MB.
+type Sieve struct {
+	limit uint64
+	bits  []byte
+	close func() error
+}
+
+func sieveBytes(limit uint64) uint64 {
+	return (limit/2 + 1 + 7) / 8
+}
+
+// NewSieve builds a sieve covering [0, limit] in memory.
+func NewSieve(limit uint64) *Sieve {
+	bits := make([]byte, sieveBytes(limit))
+	bits[0] |= 1 // 1 is not prime
+
+	for p := uint64(3); p <= limit/p; p += 2 {
+		if bits[p/2/8]&(1<<(p/2%8)) != 0 {
+			continue
+		}
+		// Odd multiples of p start at p*p and are 2p apart, which is p bits.
+		for i := p * p / 2; i <= limit/2; i += p {
+			bits[i/8] |= 1 << (i % 8)
+		}
+	}
+	return &Sieve{limit: limit, bits: bits}
+}
+
+// Limit returns the largest number the sieve can answer for.
+func (s *Sieve) Limit() uint64 {
+	return s.limit
+}
+
+// Lookup reports whether n is prime. ok is false if n is above the limit.
+func (s *Sieve) Lookup(n uint64) (prime bool, ok bool) {
+	if n > s.limit {
+		return false, false
+	}
+	if n%2 == 0 {
+		return n == 2, true
+	}
+	i := n / 2
+	return s.bits[i/8]&(1<<(i%8)) == 0, true
+}
+
+// IsPrime answers from the bitmap when n is within the limit and falls back
+// to the IsPrime function otherwise.
+func (s *Sieve) IsPrime(n *big.Int) bool {
+	if n.Sign() > 0 && n.IsUint64() {
+		if prime, ok := s.Lookup(n.Uint64()); ok {
+			return prime
+		}
+	}
+	return IsPrime(n)
+}
+
+// WriteFile stores the sieve at path.
+func (s *Sieve) WriteFile(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	header := binary.BigEndian.AppendUint64([]byte(sieveMagic), s.limit)
+	w.Write(header)
+	w.Write(s.bits)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// OpenSieve memory-maps a sieve previously stored with WriteFile. The
+// sieve must be closed once it is no longer used.
+func OpenSieve(path string) (*Sieve, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < sieveHeaderSize || string(data[:8]) != sieveMagic {
+		unmap()
+		return nil, ErrBadSieveFile
+	}
+	limit := binary.BigEndian.Uint64(data[8:sieveHeaderSize])
+	if uint64(len(data)-sieveHeaderSize) != sieveBytes(limit) {
+		unmap()
+		return nil, fmt.Errorf("%w: size does not match limit %d", ErrBadSieveFile, limit)
+	}
+
+	return &Sieve{limit: limit, bits: data[sieveHeaderSize:], close: unmap}, nil
+}
+
+// LoadOrBuildSieve opens the sieve stored at path if it covers limit.
+// Otherwise it builds a new sieve, stores it at path and maps it.
+// Limits above MaxSieveLimit are refused.
+func LoadOrBuildSieve(path string, limit uint64) (*Sieve, error) {
+	if limit > MaxSieveLimit {
+		return nil, fmt.Errorf("%w: %d exceeds %d", ErrSieveTooLarge, limit, uint64(MaxSieveLimit))
+	}
+
+	s, err := OpenSieve(path)
+	if err == nil {
+		if s.Limit() >= limit {
+			return s, nil
+		}
+		s.Close()
+	} else if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrBadSieveFile) {
+		return nil, err
+	}
+
+	if err := NewSieve(limit).WriteFile(path); err != nil {
+		return nil, err
+	}
+	return OpenSieve(path)
+}
+
+// Close releases the mapping of a sieve opened from a file. It is safe to
+// call on a nil sieve.
+func (s *Sieve) Close() error {
+	if s == nil || s.close == nil {
+		return nil
+	}
+	err := s.close()
+	s.close, s.bits = nil, nil
+	return err
+}
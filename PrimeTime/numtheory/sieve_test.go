@@ -0,0 +1,137 @@
+package numtheory_test
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
+)
+
+func TestSieveMatchesIsPrime(t *testing.T) {
+	const limit = 100001
+	s := numtheory.NewSieve(limit)
+	for n := uint64(0); n <= limit; n++ {
+		prime, ok := s.Lookup(n)
+		if !ok {
+			t.Fatalf("Lookup(%d) not covered by sieve with limit %d", n, limit)
+		}
+		if prime != numtheory.IsPrimeUint64(n) {
+			t.Fatalf("Lookup(%d) = %v, want %v", n, prime, !prime)
+		}
+	}
+
+	if _, ok := s.Lookup(limit + 1); ok {
+		t.Errorf("Lookup above limit should not be answered")
+	}
+	if !s.IsPrime(big.NewInt(1000003)) {
+		t.Errorf("IsPrime should fall back for numbers above the limit")
+	}
+}
+
+func TestSieveMarksSquareLimits(t *testing.T) {
+	// A limit that is the square of a prime needs that prime to be sieved
+	for _, limit := range []uint64{9, 25, 49, 121, 10201} {
+		s := numtheory.NewSieve(limit)
+		if prime, _ := s.Lookup(limit); prime {
+			t.Errorf("Lookup(%d) with limit %d reports a prime", limit, limit)
+		}
+	}
+}
+
+func TestLoadOrBuildSieveRejectsHugeLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "primes.sieve")
+	_, err := numtheory.LoadOrBuildSieve(path, numtheory.MaxSieveLimit+1)
+	if !errors.Is(err, numtheory.ErrSieveTooLarge) {
+		t.Errorf("Expected ErrSieveTooLarge, got %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Refused limit should not create a sieve file")
+	}
+}
+
+func TestSieveFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "primes.sieve")
+	if err := numtheory.NewSieve(5000).WriteFile(path); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+
+	s, err := numtheory.OpenSieve(path)
+	if err != nil {
+		t.Fatalf("OpenSieve returned error: %v", err)
+	}
+	defer s.Close()
+
+	if s.Limit() != 5000 {
+		t.Errorf("Expected limit 5000, got %d", s.Limit())
+	}
+	for n := uint64(0); n <= 5000; n++ {
+		if prime, _ := s.Lookup(n); prime != numtheory.IsPrimeUint64(n) {
+			t.Fatalf("Mapped Lookup(%d) = %v", n, prime)
+		}
+	}
+}
+
+func TestLoadOrBuildSieve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "primes.sieve")
+
+	s, err := numtheory.LoadOrBuildSieve(path, 1000)
+	if err != nil {
+		t.Fatalf("LoadOrBuildSieve returned error: %v", err)
+	}
+	s.Close()
+
+	// A smaller request reuses the existing file.
+	s, err = numtheory.LoadOrBuildSieve(path, 500)
+	if err != nil {
+		t.Fatalf("LoadOrBuildSieve returned error: %v", err)
+	}
+	if s.Limit() != 1000 {
+		t.Errorf("Expected existing sieve with limit 1000, got %d", s.Limit())
+	}
+	s.Close()
+
+	// A larger request rebuilds it.
+	s, err = numtheory.LoadOrBuildSieve(path, 2000)
+	if err != nil {
+		t.Fatalf("LoadOrBuildSieve returned error: %v", err)
+	}
+	if s.Limit() != 2000 {
+		t.Errorf("Expected rebuilt sieve with limit 2000, got %d", s.Limit())
+	}
+	s.Close()
+}
+
+func TestOpenSieveRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string][]byte{
+		"empty":     {},
+		"bad-magic": []byte("NOTASIEVE0000000"),
+		"truncated": append([]byte("PTSIEVE1"), 0, 0, 0, 0, 0, 0, 0x03, 0xe8, 0xff),
+	}
+	for name, data := range cases {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if _, err := numtheory.OpenSieve(path); !errors.Is(err, numtheory.ErrBadSieveFile) {
+			t.Errorf("OpenSieve(%s) error = %v, want ErrBadSieveFile", name, err)
+		}
+	}
+}
+
+func BenchmarkSieveLookup(b *testing.B) {
+	s := numtheory.NewSieve(1 << 24)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Lookup(uint64(i) % (1 << 24))
+	}
+}
+
+func BenchmarkIsPrimeWithoutSieve(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		numtheory.IsPrimeUint64(uint64(i) % (1 << 24))
+	}
+}
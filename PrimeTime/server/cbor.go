@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// This file implements the subset of CBOR (RFC 8949) needed by the binary
+// framing mode: integers, bignums (tags 2 and 3), floats, strings, arrays,
+// maps and the simple values true, false and null.
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborTagPosBignum = 2
+	cborTagNegBignum = 3
+
+	cborMaxDepth = 16
+)
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// decodeCBOR decodes a single CBOR item. Integers of any size are returned
+// as json.Number so they can be handled exactly like JSON input.
+func decodeCBOR(data []byte) (any, error) {
+	d := cborDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("cbor: unexpected data after item")
+	}
+	return v, nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) header() (major byte, info byte, arg uint64, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, errCBORTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info = b>>5, b&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.data)-d.pos < size {
+			return 0, 0, 0, errCBORTruncated
+		}
+		buf := d.data[d.pos : d.pos+size]
+		d.pos += size
+		switch size {
+		case 1:
+			arg = uint64(buf[0])
+		case 2:
+			arg = uint64(binary.BigEndian.Uint16(buf))
+		case 4:
+			arg = uint64(binary.BigEndian.Uint32(buf))
+		case 8:
+			arg = binary.BigEndian.Uint64(buf)
+		}
+		return major, info, arg, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("cbor: nesting too deep")
+	}
+	major, info, arg, err := d.header()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+
+	case cborNegInt:
+		n := new(big.Int).SetUint64(arg)
+		n.Neg(n.Add(n, big.NewInt(1)))
+		return json.Number(n.String()), nil
+
+	case cborBytes:
+		return d.bytes(arg)
+
+	case cborText:
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case cborArray:
+		// Every element takes at least one byte, which bounds the allocation.
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORTruncated
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+
+	case cborMap:
+		if arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, errCBORTruncated
+		}
+		fields := make(map[string]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("cbor: map keys must be text strings")
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = v
+		}
+		return fields, nil
+
+	case cborTag:
+		if arg != cborTagPosBignum && arg != cborTagNegBignum {
+			return nil, fmt.Errorf("cbor: unsupported tag %d", arg)
+		}
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, errors.New("cbor: bignum tag must wrap a byte string")
+		}
+		n := new(big.Int).SetBytes(b)
+		if arg == cborTagNegBignum {
+			n.Neg(n.Add(n, big.NewInt(1)))
+		}
+		return json.Number(n.String()), nil
+
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 25:
+			return cborFloat(float64(halfToFloat32(uint16(arg))))
+		case 26:
+			return cborFloat(float64(math.Float32frombits(uint32(arg))))
+		case 27:
+			return cborFloat(math.Float64frombits(arg))
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+func cborFloat(f float64) (any, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("cbor: non-finite float")
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch exp {
+	case 0:
+		// Subnormal: frac * 2^-24.
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+}
+
+// encodeCBOR encodes v. Integers, whether given as *big.Int or as an
+// integral json.Number, are always written as bignum tags so clients can
+// rely on a single representation regardless of magnitude.
+func encodeCBOR(v any) ([]byte, error) {
+	return appendCBOR(nil, v)
+}
+
+func appendCBORHeader(buf []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(buf, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(buf, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major<<5|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major<<5|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major<<5|27), arg)
+	}
+}
+
+func appendCBORBignum(buf []byte, n *big.Int) []byte {
+	if n.Sign() >= 0 {
+		b := n.Bytes()
+		buf = appendCBORHeader(buf, cborTag, cborTagPosBignum)
+		buf = appendCBORHeader(buf, cborBytes, uint64(len(b)))
+		return append(buf, b...)
+	}
+	// Negative bignums encode -1 - n.
+	m := new(big.Int).Neg(n)
+	b := m.Sub(m, big.NewInt(1)).Bytes()
+	buf = appendCBORHeader(buf, cborTag, cborTagNegBignum)
+	buf = appendCBORHeader(buf, cborBytes, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendCBOR(buf []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, cborSimple<<5|22), nil
+	case bool:
+		if v {
+			return append(buf, cborSimple<<5|21), nil
+		}
+		return append(buf, cborSimple<<5|20), nil
+	case string:
+		buf = appendCBORHeader(buf, cborText, uint64(len(v)))
+		return append(buf, v...), nil
+	case []byte:
+		buf = appendCBORHeader(buf, cborBytes, uint64(len(v)))
+		return append(buf, v...), nil
+	case int:
+		return appendCBORBignum(buf, big.NewInt(int64(v))), nil
+	case *big.Int:
+		return appendCBORBignum(buf, v), nil
+	case json.Number:
+		if n, ok := new(big.Int).SetString(string(v), 10); ok {
+			return appendCBORBignum(buf, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, cborSimple<<5|27)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(f)), nil
+	case []any:
+		buf = appendCBORHeader(buf, cborArray, uint64(len(v)))
+		for _, item := range v {
+			var err error
+			if buf, err = appendCBOR(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf = appendCBORHeader(buf, cborMap, uint64(len(v)))
+		for _, key := range keys {
+			buf = appendCBORHeader(buf, cborText, uint64(len(key)))
+			buf = append(buf, key...)
+			var err error
+			if buf, err = appendCBOR(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case response:
+		// Always put "method" first so responses are easy to recognise.
+		buf = appendCBORHeader(buf, cborMap, 2)
+		buf, _ = appendCBOR(buf, "method")
+		buf, _ = appendCBOR(buf, v.Method)
+		buf, _ = appendCBOR(buf, v.Field)
+		return appendCBOR(buf, v.Value)
+	default:
+		// Structured values such as method schemas are converted through
+		// their JSON form.
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var generic any
+		if err := unmarshalUseNumber(data, &generic); err != nil {
+			return nil, err
+		}
+		return appendCBOR(buf, generic)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestDecodeCBORNumbers(t *testing.T) {
+	cases := map[string]json.Number{
+		"07":                     "7",
+		"1903e8":                 "1000",
+		"20":                     "-1",
+		"3903e7":                 "-1000",
+		"1bffffffffffffffff":     "18446744073709551615",
+		"c249010000000000000000": "18446744073709551616",
+		"c349010000000000000000": "-18446744073709551617",
+		"f93e00":                 "1.5",
+		"fa47c35000":             "100000",
+		"fb3ff8000000000000":     "1.5",
+	}
+	for in, want := range cases {
+		data, _ := hex.DecodeString(in)
+		got, err := decodeCBOR(data)
+		if err != nil {
+			t.Errorf("decodeCBOR(%s) returned error: %v", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("decodeCBOR(%s) = %v, want %s", in, got, want)
+		}
+	}
+}
+
+func TestDecodeCBORRejectsMalformed(t *testing.T) {
+	cases := []string{
+		"",
+		"1a0000",             // truncated argument
+		"43aabb",             // byte string shorter than declared
+		"9bffffffffffffffff", // huge array length
+		"a1016161",           // non-text map key
+		"c16161",             // unsupported tag
+		"c207",               // bignum without byte string
+		"f97e00",             // NaN
+		"0707",               // trailing data
+	}
+	for _, in := range cases {
+		data, _ := hex.DecodeString(in)
+		if _, err := decodeCBOR(data); err == nil {
+			t.Errorf("decodeCBOR(%s) succeeded, want error", in)
+		}
+	}
+}
+
+func TestEncodeCBORUsesBignums(t *testing.T) {
+	n, _ := new(big.Int).SetString("-18446744073709551617", 10)
+	cases := []struct {
+		in   any
+		want string
+	}{
+		{big.NewInt(7), "c24107"},
+		{big.NewInt(0), "c240"},
+		{big.NewInt(-1), "c340"},
+		{n, "c349010000000000000000"},
+		{json.Number("1000"), "c24203e8"},
+		{true, "f5"},
+		{response{Method: "isPrime", Field: "prime", Value: false}, "a2666d6574686f646769735072696d65657072696d65f4"},
+	}
+	for _, c := range cases {
+		got, err := encodeCBOR(c.in)
+		if err != nil {
+			t.Errorf("encodeCBOR(%v) returned error: %v", c.in, err)
+			continue
+		}
+		if hex.EncodeToString(got) != c.want {
+			t.Errorf("encodeCBOR(%v) = %x, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	in := map[string]any{
+		"method": "listMethods",
+		"list":   []any{json.Number("1"), "two", nil, false},
+		"nested": map[string]any{"big": json.Number("-123456789012345678901234567890")},
+	}
+	data, err := encodeCBOR(in)
+	if err != nil {
+		t.Fatalf("encodeCBOR returned error: %v", err)
+	}
+	out, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatalf("decodeCBOR returned error: %v", err)
+	}
+
+	want, _ := json.Marshal(in)
+	got, _ := json.Marshal(out)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Round trip changed value: got %s, want %s", got, want)
+	}
+}
+
+// semiprimes are representative isPrime inputs, from 32 to 150 bits.
+var semiprimes = []struct {
+	name   string
+	number string
+}{
+	{"32bit", "4294049777"},                                      // 65521 * 65537
+	{"64bit", "1000000016000000063"},                             // 1000000007 * 1000000009
+	{"150bit", "1427247692705959880439315947500961989719490561"}, // (2^61-1) * (2^89-1)
+}
+
+// benchmarkFraming decodes an isPrime request for each semiprime and encodes
+// its response, the per-request work the framing adds around dispatch.
+func benchmarkFraming(b *testing.B, f framing, frame func(number string) []byte) {
+	for _, sp := range semiprimes {
+		data := frame(sp.number)
+		b.Run(sp.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req, err := f.decode(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := f.encode(response{Method: req.Method, Field: "prime", Value: false}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkJSONFraming(b *testing.B) {
+	benchmarkFraming(b, jsonFraming{}, func(number string) []byte {
+		return []byte(`{"method":"isPrime","number":` + number + "}\n")
+	})
+}
+
+func BenchmarkBinaryFraming(b *testing.B) {
+	benchmarkFraming(b, binaryFraming{}, func(number string) []byte {
+		data, err := encodeCBOR(map[string]any{"method": "isPrime", "number": json.Number(number)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return data
+	})
+}
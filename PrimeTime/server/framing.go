@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// binaryMagic selects the binary framing when it is the first byte sent on a
+// connection. It can never start a line of JSON, so newline-delimited
+// clients are unaffected.
+const binaryMagic byte = 0xCB
+
+// maxFrameSize bounds the payload of a single binary frame.
+const maxFrameSize = 1 << 20
+
+// framing reads requests from and writes responses to a connection in one
+// wire format.
+type framing interface {
+	readFrame() ([]byte, error)
+	decode(frame []byte) (request, error)
+	encode(v any) ([]byte, error)
+}
+
+// jsonFraming is the default protocol: one JSON object per line.
+type jsonFraming struct {
+	reader *bufio.Reader
+}
+
+func (f jsonFraming) readFrame() ([]byte, error) {
+	return f.reader.ReadBytes('\n')
+}
+
+func (f jsonFraming) decode(frame []byte) (request, error) {
+	var req request
+	err := json.Unmarshal(frame, &req)
+	return req, err
+}
+
+func (f jsonFraming) encode(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// binaryFraming carries CBOR maps with the same fields as the JSON protocol,
+// each prefixed by its length as a big-endian uint32.
+type binaryFraming struct {
+	reader *bufio.Reader
+}
+
+func (f binaryFraming) readFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(f.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit of %d", size, maxFrameSize)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(f.reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (f binaryFraming) decode(frame []byte) (request, error) {
+	v, err := decodeCBOR(frame)
+	if err != nil {
+		return request{}, err
+	}
+	fields, ok := v.(map[string]any)
+	if !ok {
+		return request{}, errors.New("request must be a CBOR map")
+	}
+	return newRequest(fields)
+}
+
+func (f binaryFraming) encode(v any) ([]byte, error) {
+	payload, err := encodeCBOR(v)
+	if err != nil {
+		return nil, err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(payload)), uint32(len(payload)))
+	return append(frame, payload...), nil
+}
+
+// detectFraming picks the wire format from the first byte of a connection.
+func detectFraming(reader *bufio.Reader) (framing, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == binaryMagic {
+		reader.Discard(1)
+		return binaryFraming{reader: reader}, nil
+	}
+	return jsonFraming{reader: reader}, nil
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
+)
+
+const (
+	// maxOperandBits bounds integer arguments to the arithmetic methods. The
+	// largest modPow it allows costs 64^3 = 262144 units, which fits in the
+	// default per-connection burst.
+	maxOperandBits = 4096
+	// maxTotientBits bounds totient inputs, which have to be factorized.
+	maxTotientBits = 80
+)
+
+// methods is the registry consulted for every request.
+var methods = newMethods()
+
+// sieve answers isPrime for small numbers when it has been loaded.
+var sieve *numtheory.Sieve
+
+func newMethods() *registry {
+	r := newRegistry()
+	r.register(methodSpec{
+		Name:    "isPrime",
+		Params:  []paramSpec{{Name: "number", Type: typeNumber, Required: true}},
+		Result:  paramSpec{Name: "prime", Type: typeBoolean},
+		Handler: isPrime,
+		Cost:    isPrimeCost,
+	})
+	r.register(methodSpec{
+		Name:    "modPow",
+		Params:  integerParams("base", "exponent", "modulus"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: modPow,
+		Cost:    modPowCost,
+	})
+	r.register(methodSpec{
+		Name:    "modInverse",
+		Params:  integerParams("number", "modulus"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: modInverse,
+		Cost:    quadraticCost("number", "modulus"),
+	})
+	r.register(methodSpec{
+		Name:    "gcd",
+		Params:  integerParams("a", "b"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: gcd,
+		Cost:    quadraticCost("a", "b"),
+	})
+	r.register(methodSpec{
+		Name:    "lcm",
+		Params:  integerParams("a", "b"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: lcm,
+		Cost:    quadraticCost("a", "b"),
+	})
+	r.register(methodSpec{
+		Name:    "totient",
+		Params:  integerParams("number"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: totient,
+		Cost:    totientCost,
+	})
+	r.register(methodSpec{
+		Name:    "jacobi",
+		Params:  integerParams("a", "n"),
+		Result:  paramSpec{Name: "result", Type: typeInteger},
+		Handler: jacobi,
+		Cost:    quadraticCost("a", "n"),
+	})
+	return r
+}
+
+func integerParams(names ...string) []paramSpec {
+	specs := make([]paramSpec, len(names))
+	for i, name := range names {
+		specs[i] = paramSpec{Name: name, Type: typeInteger, Required: true}
+	}
+	return specs
+}
+
+// parseInteger parses an integer argument and enforces maxOperandBits.
+func parseInteger(num json.Number) (*big.Int, error) {
+	n, err := numtheory.ParseNumber(num)
+	if err != nil {
+		return nil, err
+	}
+	if n.BitLen() > maxOperandBits {
+		return nil, fmt.Errorf("%w: more than %d bits", numtheory.ErrTooLarge, maxOperandBits)
+	}
+	return n, nil
+}
+
+// words returns the size of n in 64-bit machine words, at least one.
+func words(n *big.Int) float64 {
+	return math.Max(1, math.Ceil(float64(n.BitLen())/64))
+}
+
+// isPrimeCost grows with the cube of the input size, like a Miller-Rabin
+// round. Inputs answered by the sieve cost a single unit.
+func isPrimeCost(p params) float64 {
+	n, err := numtheory.ParseNumber(p.number("number"))
+	if err != nil {
+		return 1
+	}
+	if sieve != nil && n.IsUint64() && n.Uint64() <= sieve.Limit() {
+		return 1
+	}
+	w := words(n)
+	return w * w * w
+}
+
+// modPowCost scales with the exponent length times the cost of one modular
+// multiplication.
+func modPowCost(p params) float64 {
+	m := words(p.integer("modulus"))
+	return words(p.integer("exponent")) * m * m
+}
+
+// quadraticCost covers gcd-like methods, whose cost grows with the product of
+// the operand sizes.
+func quadraticCost(a, b string) func(params) float64 {
+	return func(p params) float64 {
+		return math.Max(1, words(p.integer(a))*words(p.integer(b))/16)
+	}
+}
+
+// totientCost follows Pollard's rho, which takes around n^(1/4) steps.
+func totientCost(p params) float64 {
+	bits := p.integer("number").BitLen()
+	return 1 + math.Exp2(float64(bits)/4)/128
+}
+
+func isPrime(p params) (any, error) {
+	if sieve == nil {
+		return numtheory.IsPrimeNumber(p.number("number")), nil
+	}
+	n, err := numtheory.ParseNumber(p.number("number"))
+	if err != nil {
+		return false, nil
+	}
+	return sieve.IsPrime(n), nil
+}
+
+func modPow(p params) (any, error) {
+	return numtheory.ModPow(p.integer("base"), p.integer("exponent"), p.integer("modulus"))
+}
+
+func modInverse(p params) (any, error) {
+	return numtheory.ModInverse(p.integer("number"), p.integer("modulus"))
+}
+
+func gcd(p params) (any, error) {
+	return numtheory.GCD(p.integer("a"), p.integer("b")), nil
+}
+
+func lcm(p params) (any, error) {
+	return numtheory.LCM(p.integer("a"), p.integer("b")), nil
+}
+
+func totient(p params) (any, error) {
+	n := p.integer("number")
+	if n.BitLen() > maxTotientBits {
+		return nil, fmt.Errorf("%w: more than %d bits", numtheory.ErrTooLarge, maxTotientBits)
+	}
+	return numtheory.Totient(n)
+}
+
+func jacobi(p params) (any, error) {
+	return numtheory.Jacobi(p.integer("a"), p.integer("n"))
+}
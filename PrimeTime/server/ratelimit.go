@@ -0,0 +1,132 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/config"
+)
+
+// tokenBucket refills at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// connBudget charges a connection's requests against its own bucket and the
+// bucket shared by every connection from the same client IP. A request is
+// only charged if both have room for it.
+type connBudget struct {
+	ip     string
+	rate   float64
+	burst  float64
+	bucket tokenBucket
+}
+
+func newConnBudget(ip string) *connBudget {
+	return &connBudget{
+		ip:     ip,
+		rate:   config.ConnCostRate,
+		burst:  config.ConnCostBurst,
+		bucket: tokenBucket{tokens: config.ConnCostBurst, last: time.Now()},
+	}
+}
+
+func (b *connBudget) charge(cost float64) bool {
+	b.bucket.refill(time.Now(), b.rate, b.burst)
+	if b.bucket.tokens < cost {
+		return false
+	}
+	if !clientBudgets.allow(b.ip, cost) {
+		return false
+	}
+	b.bucket.tokens -= cost
+	return true
+}
+
+func (b *connBudget) capacity() float64 {
+	return min(b.burst, clientBudgets.burst)
+}
+
+// clientBudgets holds the per-IP cost budgets shared by TCP connections and
+// UDP datagrams.
+var clientBudgets *limiter
+
+// ipBudget charges only the per-IP bucket.
+type ipBudget string
+
+func (ip ipBudget) charge(cost float64) bool {
+	return clientBudgets.allow(string(ip), cost)
+}
+
+func (ip ipBudget) capacity() float64 {
+	return clientBudgets.burst
+}
+
+// limiter keeps one token bucket per key, such as a client IP address.
+type limiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+// pruneInterval is how often buckets that have refilled completely are
+// dropped, so that spoofed sources cannot grow the map without bound.
+const pruneInterval = time.Minute
+
+func newLimiter(rate, burst float64) *limiter {
+	return &limiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes cost tokens from the bucket for key and reports whether there
+// were enough of them.
+func (l *limiter) allow(key string, cost float64) bool {
+	return l.allowAt(key, cost, time.Now())
+}
+
+func (l *limiter) allowAt(key string, cost float64, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastPrune) > pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, l.rate, l.burst)
+
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(now, l.rate, l.burst)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllowsBurstThenRefills(t *testing.T) {
+	l := newLimiter(10, 5)
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if !l.allowAt("a", 1, now) {
+			t.Fatalf("Request %d within burst was rejected", i)
+		}
+	}
+	if l.allowAt("a", 1, now) {
+		t.Errorf("Request over burst was allowed")
+	}
+	if !l.allowAt("b", 1, now) {
+		t.Errorf("Other keys should have their own bucket")
+	}
+
+	// 10 tokens per second refills one token every 100ms.
+	if !l.allowAt("a", 1, now.Add(100*time.Millisecond)) {
+		t.Errorf("Bucket did not refill")
+	}
+	if l.allowAt("a", 1, now.Add(100*time.Millisecond)) {
+		t.Errorf("Bucket refilled too much")
+	}
+}
+
+func TestLimiterPrunesIdleBuckets(t *testing.T) {
+	// Slow enough that a drained bucket is still far from full when pruned.
+	l := newLimiter(0.01, 5)
+	now := time.Now()
+	l.allowAt("idle", 0, now)
+	l.allowAt("busy", 5, now)
+
+	l.allowAt("other", 1, now.Add(pruneInterval+time.Second))
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Errorf("Idle bucket was not pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Errorf("Drained bucket should be kept")
+	}
+}
+
+func TestDispatchTellsThrottledFromTooExpensive(t *testing.T) {
+	saved := clientBudgets
+	defer func() { clientBudgets = saved }()
+	clientBudgets = newLimiter(0, 1000)
+	b := &connBudget{ip: "a", burst: 100, bucket: tokenBucket{tokens: 100, last: time.Now()}}
+
+	gcd := func(bits uint) request {
+		n := new(big.Int).Lsh(big.NewInt(1), bits)
+		return request{Method: "gcd", Params: params{"a": json.Number(n.String()), "b": json.Number(n.String())}}
+	}
+
+	// 2^4000 is 63 words, so gcd costs 63*63/16 = 248 units, more than the
+	// connection can ever hold.
+	if _, err := methods.dispatch(gcd(4000), b); !errors.Is(err, ErrTooExpensive) {
+		t.Errorf("Expected ErrTooExpensive, got %v", err)
+	}
+
+	// 2^2500 is 40 words, so gcd costs 100 units: once fits, twice does not.
+	if _, err := methods.dispatch(gcd(2500), b); err != nil {
+		t.Fatalf("Request within burst failed: %v", err)
+	}
+	if _, err := methods.dispatch(gcd(2500), b); !errors.Is(err, ErrThrottled) {
+		t.Errorf("Expected ErrThrottled, got %v", err)
+	}
+}
+
+func TestCapacityIsSmallerBurst(t *testing.T) {
+	saved := clientBudgets
+	defer func() { clientBudgets = saved }()
+
+	for _, c := range []struct{ conn, ip, want float64 }{{100, 1000, 100}, {1000, 100, 100}} {
+		clientBudgets = newLimiter(0, c.ip)
+		b := &connBudget{ip: "a", burst: c.conn}
+		if got := b.capacity(); got != c.want {
+			t.Errorf("capacity with bursts %v and %v = %v, want %v", c.conn, c.ip, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+)
+
+var (
+	ErrThrottled     = errors.New("rate limited")
+	ErrTooExpensive  = errors.New("request too expensive")
+	ErrUnknownMethod = errors.New("unknown method")
+	ErrMissingParam  = errors.New("missing parameter")
+	ErrInvalidParam  = errors.New("invalid parameter")
+)
+
+// Parameter and result types advertised by listMethods.
+const (
+	typeNumber  = "number"
+	typeInteger = "integer"
+	typeBoolean = "boolean"
+	typeArray   = "array"
+)
+
+// paramSpec describes a named field of a request or response.
+type paramSpec struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+// methodSpec declares a method that can be called over the protocol.
+// Requests are validated against Params before Handler is invoked, and the
+// value returned by Handler is sent back in the field named by Result.
+// Cost estimates the work a request will take, in units of roughly one
+// 64-bit primality test; methods without one cost a single unit.
+type methodSpec struct {
+	Name    string                      `json:"name"`
+	Params  []paramSpec                 `json:"params"`
+	Result  paramSpec                   `json:"result"`
+	Handler func(p params) (any, error) `json:"-"`
+	Cost    func(p params) float64      `json:"-"`
+}
+
+// params holds the fields of a request other than "method". Numbers are
+// kept as json.Number so no precision is lost before a handler sees them.
+type params map[string]any
+
+func (p params) number(name string) json.Number {
+	n, _ := p[name].(json.Number)
+	return n
+}
+
+// integer returns a parameter that has been validated as typeInteger.
+func (p params) integer(name string) *big.Int {
+	n, _ := parseInteger(p.number(name))
+	return n
+}
+
+type request struct {
+	Method string
+	Params params
+}
+
+func (r *request) UnmarshalJSON(data []byte) error {
+	var fields map[string]any
+	if err := unmarshalUseNumber(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return errors.New("request must be a JSON object")
+	}
+	req, err := newRequest(fields)
+	if err != nil {
+		return err
+	}
+	*r = req
+	return nil
+}
+
+// newRequest splits the decoded fields of a request into its method and
+// parameters.
+func newRequest(fields map[string]any) (request, error) {
+	method, ok := fields["method"].(string)
+	if !ok {
+		return request{}, errors.New("missing or invalid method field")
+	}
+	delete(fields, "method")
+	return request{Method: method, Params: fields}, nil
+}
+
+func unmarshalUseNumber(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// errorResponse replaces a response when the registry refuses a request.
+// Over TCP the connection stays open only for requests refused as over
+// budget.
+type errorResponse struct {
+	Method string `json:"method,omitempty"`
+	Error  string `json:"error"`
+}
+
+type response struct {
+	Method string
+	Field  string
+	Value  any
+}
+
+func (r response) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"method": r.Method,
+		r.Field:  r.Value,
+	})
+}
+
+type registry struct {
+	methods map[string]*methodSpec
+}
+
+func newRegistry() *registry {
+	r := &registry{methods: make(map[string]*methodSpec)}
+	r.register(methodSpec{
+		Name:    "listMethods",
+		Params:  []paramSpec{},
+		Result:  paramSpec{Name: "methods", Type: typeArray},
+		Handler: func(params) (any, error) { return r.list(), nil },
+	})
+	return r
+}
+
+func (r *registry) register(spec methodSpec) {
+	if _, exists := r.methods[spec.Name]; exists {
+		panic(fmt.Sprintf("method %q registered twice", spec.Name))
+	}
+	r.methods[spec.Name] = &spec
+}
+
+// list returns the registered method schemas sorted by name.
+func (r *registry) list() []methodSpec {
+	specs := make([]methodSpec, 0, len(r.methods))
+	for _, spec := range r.methods {
+		specs = append(specs, *spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs
+}
+
+// budget is charged the estimated cost of each request before it runs.
+type budget interface {
+	charge(cost float64) bool
+	// capacity is the largest cost the budget can hold when full.
+	capacity() float64
+}
+
+// dispatch validates req and runs it. If b is not nil, the request is first
+// charged against it. ErrThrottled is returned when it is over the remaining
+// budget, and ErrTooExpensive when it is over what the budget can ever hold,
+// so that retrying is pointless.
+func (r *registry) dispatch(req request, b budget) (response, error) {
+	spec, ok := r.methods[req.Method]
+	if !ok {
+		return response{}, fmt.Errorf("%w: %q", ErrUnknownMethod, req.Method)
+	}
+
+	if err := spec.validate(req.Params); err != nil {
+		return response{}, fmt.Errorf("%s: %w", spec.Name, err)
+	}
+
+	if b != nil {
+		cost := spec.cost(req.Params)
+		if cost > b.capacity() {
+			return response{}, fmt.Errorf("%s: %w: request cost %.0f exceeds budget of %.0f", spec.Name, ErrTooExpensive, cost, b.capacity())
+		}
+		if !b.charge(cost) {
+			return response{}, fmt.Errorf("%s: %w: request cost %.0f exceeds remaining budget", spec.Name, ErrThrottled, cost)
+		}
+	}
+
+	value, err := spec.Handler(req.Params)
+	if err != nil {
+		return response{}, fmt.Errorf("%s: %w", spec.Name, err)
+	}
+
+	return response{
+		Method: spec.Name,
+		Field:  spec.Result.Name,
+		Value:  value,
+	}, nil
+}
+
+func (spec *methodSpec) cost(p params) float64 {
+	if spec.Cost == nil {
+		return 1
+	}
+	return spec.Cost(p)
+}
+
+func (spec *methodSpec) validate(p params) error {
+	for _, param := range spec.Params {
+		value, ok := p[param.Name]
+		if !ok {
+			if param.Required {
+				return fmt.Errorf("%w %q", ErrMissingParam, param.Name)
+			}
+			continue
+		}
+		if err := checkType(value, param.Type); err != nil {
+			return fmt.Errorf("%w %q: %v", ErrInvalidParam, param.Name, err)
+		}
+	}
+	return nil
+}
+
+func checkType(value any, typ string) error {
+	ok := false
+	switch typ {
+	case typeNumber:
+		_, ok = value.(json.Number)
+	case typeInteger:
+		num, isNumber := value.(json.Number)
+		if !isNumber {
+			break
+		}
+		if _, err := parseInteger(num); err != nil {
+			return err
+		}
+		ok = true
+	case typeBoolean:
+		_, ok = value.(bool)
+	case typeArray:
+		_, ok = value.([]any)
+	}
+	if !ok {
+		return fmt.Errorf("expected %s", typ)
+	}
+	return nil
+}
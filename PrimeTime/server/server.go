@@ -2,24 +2,15 @@ package server
 
 import (
 	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bhaski-1234/protohackers/PrimeTime/config"
+	"github.com/bhaski-1234/protohackers/PrimeTime/numtheory"
 	"log"
 	"net"
+	"time"
 )
 
-type request struct {
-	Method string      `json:"method"`
-	Number json.Number `json:"number"` // Using json.Number to handle both integers and floats
-}
-
-type response struct {
-	Method  string `json:"method"`
-	IsPrime bool   `json:"prime"`
-}
-
 func writeToConnection(conn net.Conn, data string) {
 	_, err := conn.Write([]byte(data))
 	if err != nil {
@@ -30,74 +21,95 @@ func writeToConnection(conn net.Conn, data string) {
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
+	f, err := detectFraming(reader)
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return
+	}
+	costs := newConnBudget(remoteIP(conn.RemoteAddr()))
+
 	for {
-		line, err := reader.ReadString('\n')
+		frame, err := f.readFrame()
 		if err != nil {
 			fmt.Println("Error reading from connection:", err)
 			break
 		}
 
-		var req request
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
+		req, err := f.decode(frame)
+		if err != nil {
 			fmt.Println("Error unmarshalling request:", err)
 			break
 		}
 
-		resp, err := handlePrimeRequest(req)
-		if err != nil {
+		var out any
+		resp, err := methods.dispatch(req, costs)
+		keepOpen := true
+		switch {
+		case errors.Is(err, ErrThrottled), errors.Is(err, ErrTooExpensive):
+			// Over budget: tell the client and keep the connection open.
+			out = errorResponse{Method: req.Method, Error: err.Error()}
+		case err != nil:
+			// Reported as over UDP, but then the connection is closed.
 			fmt.Println("Error handling request:", err)
-			break
+			out = errorResponse{Method: req.Method, Error: err.Error()}
+			keepOpen = false
+		default:
+			out = resp
 		}
 
-		respData, err := json.Marshal(resp)
+		respData, err := f.encode(out)
 		if err != nil {
 			fmt.Println("Error marshalling response:", err)
 			break
 		}
 
-		writeToConnection(conn, string(respData)+"\n")
+		writeToConnection(conn, string(respData))
+		if !keepOpen {
+			return
+		}
 	}
 }
 
-func handlePrimeRequest(req request) (response, error) {
-	if req.Method != "isPrime" {
-		return response{}, errors.New("unknown method")
-	}
-	if req.Number == "" {
-		return response{}, errors.New("missing number field")
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
 	}
-
-	return response{
-		Method:  "isPrime",
-		IsPrime: isPrime(req.Number),
-	}, nil
+	return addr.String()
 }
 
-func isPrime(num json.Number) bool {
-	n, err := num.Float64()
+func loadSieve() error {
+	if config.SieveLimit == 0 {
+		return nil
+	}
+	start := time.Now()
+	s, err := numtheory.LoadOrBuildSieve(config.SieveFile, config.SieveLimit)
 	if err != nil {
-		return false
+		return err
 	}
+	sieve = s
+	log.Printf("Loaded sieve up to %d from %s in %v", s.Limit(), config.SieveFile, time.Since(start))
+	return nil
+}
 
-	if n != float64(int(n)) {
-		return false
+func RunServer() {
+	if err := loadSieve(); err != nil {
+		fmt.Printf("Failed to load sieve: %v\n", err)
+		return
 	}
+	defer sieve.Close()
 
-	// Convert to int for prime check
-	intN := int(n)
-	if intN < 2 {
-		return false
-	}
+	clientBudgets = newLimiter(config.IPCostRate, config.IPCostBurst)
 
-	for i := 2; i*i <= intN; i++ {
-		if intN%i == 0 {
-			return false
+	if config.UDP {
+		udp, err := newUDPServer()
+		if err != nil {
+			fmt.Printf("Failed to start UDP listener: %v\n", err)
+			return
 		}
+		defer udp.conn.Close()
+		go udp.serve()
 	}
-	return true
-}
 
-func RunServer() {
 	lsnr, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port))
 	if err != nil {
 		fmt.Printf("Failed to start server: %v\n", err)
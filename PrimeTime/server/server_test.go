@@ -2,7 +2,13 @@ package server_test
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"strings"
 	"sync"
@@ -108,6 +114,29 @@ func TestMalformedJSON(t *testing.T) {
 	}
 }
 
+// expectErrorThenClose reads the error object a refused request gets, as
+// over UDP, and checks that the connection is closed after it.
+func expectErrorThenClose(t *testing.T, reader *bufio.Reader, method, want string) {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected an error response, got error: %v", err)
+	}
+	var refused struct {
+		Method string `json:"method"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(line), &refused); err != nil {
+		t.Fatalf("Invalid JSON in response: %v", err)
+	}
+	if refused.Method != method || !strings.Contains(refused.Error, want) {
+		t.Errorf("Expected %q error for %s, got %s", want, method, line)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("Expected connection to be closed after %s error", method)
+	}
+}
+
 func TestMissingFields(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:9000")
 	if err != nil {
@@ -121,11 +150,7 @@ func TestMissingFields(t *testing.T) {
 		t.Fatalf("Failed to write to connection: %v", err)
 	}
 
-	reader := bufio.NewReader(conn)
-	_, err = reader.ReadString('\n')
-	if err == nil {
-		t.Errorf("Expected connection to be closed after malformed request")
-	}
+	expectErrorThenClose(t, bufio.NewReader(conn), "isPrime", "missing parameter")
 }
 
 func TestConcurrentClients(t *testing.T) {
@@ -167,3 +192,363 @@ func TestConcurrentClients(t *testing.T) {
 		t.Errorf("Concurrent test timed out")
 	}
 }
+
+func TestListMethods(t *testing.T) {
+	resp, err := sendRequest(t, `{"method":"listMethods"}`)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	var result struct {
+		Method  string `json:"method"`
+		Methods []struct {
+			Name   string `json:"name"`
+			Params []struct {
+				Name     string `json:"name"`
+				Type     string `json:"type"`
+				Required bool   `json:"required"`
+			} `json:"params"`
+			Result struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			} `json:"result"`
+		} `json:"methods"`
+	}
+	if err := json.Unmarshal([]byte(resp), &result); err != nil {
+		t.Fatalf("Invalid JSON in response: %v", err)
+	}
+	if result.Method != "listMethods" {
+		t.Fatalf("Unexpected response: %s", resp)
+	}
+
+	for _, m := range result.Methods {
+		if m.Name != "isPrime" {
+			continue
+		}
+		if len(m.Params) != 1 || m.Params[0].Name != "number" || !m.Params[0].Required {
+			t.Errorf("Unexpected isPrime params: %+v", m.Params)
+		}
+		if m.Result.Name != "prime" || m.Result.Type != "boolean" {
+			t.Errorf("Unexpected isPrime result: %+v", m.Result)
+		}
+		return
+	}
+	t.Errorf("isPrime missing from listMethods: %s", resp)
+}
+
+func TestUnknownMethod(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Connection error: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(`{"method":"isComposite","number":4}` + "\n"))
+	if err != nil {
+		t.Fatalf("Failed to write to connection: %v", err)
+	}
+
+	expectErrorThenClose(t, bufio.NewReader(conn), "isComposite", "unknown method")
+}
+
+// CBOR-encoded {"method":"isPrime","prime":<bool>} as sent by the server
+const (
+	cborPrimeTrue  = "a2666d6574686f646769735072696d65657072696d65f5"
+	cborPrimeFalse = "a2666d6574686f646769735072696d65657072696d65f4"
+)
+
+// cborIsPrime encodes {"method":"isPrime","number":<bignum>}
+func cborIsPrime(n []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{0xa2, 0x66})
+	buf.WriteString("method")
+	buf.WriteByte(0x67)
+	buf.WriteString("isPrime")
+	buf.WriteByte(0x66)
+	buf.WriteString("number")
+	buf.Write([]byte{0xc2, 0x40 | byte(len(n))})
+	buf.Write(n)
+	return buf.Bytes()
+}
+
+func writeFrame(t *testing.T, conn net.Conn, payload []byte) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	if _, err := conn.Write(append(frame, payload...)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+}
+
+func readFrame(t *testing.T, reader io.Reader) []byte {
+	t.Helper()
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatalf("Failed to read frame header: %v", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("Failed to read frame payload: %v", err)
+	}
+	return payload
+}
+
+func TestBinaryFraming(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Connection error: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{0xCB}); err != nil {
+		t.Fatalf("Failed to write magic byte: %v", err)
+	}
+
+	// 2^127 - 1 needs the full 16 bytes of the bignum to stay exact
+	mersenne, _ := hex.DecodeString("7fffffffffffffffffffffffffffffff")
+	cases := []struct {
+		number []byte
+		want   string
+	}{
+		{[]byte{7}, cborPrimeTrue},
+		{[]byte{10}, cborPrimeFalse},
+		{mersenne, cborPrimeTrue},
+	}
+
+	reader := bufio.NewReader(conn)
+	for _, c := range cases {
+		writeFrame(t, conn, cborIsPrime(c.number))
+		got := readFrame(t, reader)
+		if hex.EncodeToString(got) != c.want {
+			t.Errorf("Unexpected response for %x: %x", c.number, got)
+		}
+	}
+}
+
+func TestBinaryFramingMalformed(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Connection error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte{0xCB})
+	writeFrame(t, conn, []byte{0xff})
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("Expected connection to be closed after malformed frame")
+	}
+}
+
+func TestModularMethods(t *testing.T) {
+	cases := []struct {
+		req  string
+		want string
+	}{
+		{`{"method":"modPow","base":4,"exponent":13,"modulus":497}`, "445"},
+		{`{"method":"modPow","base":2,"exponent":1000,"modulus":1000000000000000000000000000057}`, "141502251827270929530186206576"},
+		{`{"method":"modInverse","number":3,"modulus":11}`, "4"},
+		{`{"method":"gcd","a":123456789012345678901234567890,"b":9876543210}`, "90"},
+		{`{"method":"lcm","a":4,"b":6.0}`, "12"},
+		{`{"method":"totient","number":36}`, "12"},
+		{`{"method":"jacobi","a":1001,"n":9907}`, "-1"},
+	}
+
+	for _, c := range cases {
+		resp, err := sendRequest(t, c.req)
+		if err != nil {
+			t.Fatalf("Failed to read response for %s: %v", c.req, err)
+		}
+
+		var result struct {
+			Method string      `json:"method"`
+			Result json.Number `json:"result"`
+		}
+		if err := json.Unmarshal([]byte(resp), &result); err != nil {
+			t.Fatalf("Invalid JSON in response: %v", err)
+		}
+		if string(result.Result) != c.want {
+			t.Errorf("Request %s: expected %s, got %s", c.req, c.want, resp)
+		}
+	}
+}
+
+func TestModularMethodsRejectInvalidInput(t *testing.T) {
+	requests := []struct{ method, req string }{
+		{"modPow", `{"method":"modPow","base":2,"exponent":3,"modulus":0}`},
+		{"modInverse", `{"method":"modInverse","number":6,"modulus":9}`},
+		{"gcd", `{"method":"gcd","a":1.5,"b":3}`},
+		{"jacobi", `{"method":"jacobi","a":3,"n":8}`},
+		{"lcm", `{"method":"lcm","a":4}`},
+	}
+
+	for _, r := range requests {
+		conn, err := net.Dial("tcp", "localhost:9000")
+		if err != nil {
+			t.Fatalf("Connection error: %v", err)
+		}
+
+		if _, err := conn.Write([]byte(r.req + "\n")); err != nil {
+			t.Fatalf("Failed to write to connection: %v", err)
+		}
+
+		expectErrorThenClose(t, bufio.NewReader(conn), r.method, r.method)
+		conn.Close()
+	}
+}
+
+// sendDatagram needs the server to run with -udp.
+func sendDatagram(t *testing.T, payload []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("Failed to send datagram: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 65536)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read datagram: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestUDPSingleRequest(t *testing.T) {
+	reply := sendDatagram(t, []byte(`{"method":"isPrime","number":13}`))
+
+	var result response
+	if err := json.Unmarshal(reply, &result); err != nil {
+		t.Fatalf("Invalid JSON in reply: %v", err)
+	}
+	if result.Method != "isPrime" || !result.Prime {
+		t.Errorf("Unexpected reply: %s", reply)
+	}
+}
+
+func TestUDPBatch(t *testing.T) {
+	reply := sendDatagram(t, []byte(`[{"method":"isPrime","number":13},{"method":"isPrime","number":15},{"method":"bogus"}]`))
+
+	var results []struct {
+		Method string `json:"method"`
+		Prime  bool   `json:"prime"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &results); err != nil {
+		t.Fatalf("Invalid JSON in reply: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 replies, got %s", reply)
+	}
+	if !results[0].Prime || results[1].Prime || results[1].Error != "" {
+		t.Errorf("Unexpected replies: %s", reply)
+	}
+	if results[2].Error == "" {
+		t.Errorf("Expected error for unknown method, got %s", reply)
+	}
+}
+
+func TestUDPRejectsMalformedAndOversize(t *testing.T) {
+	for name, payload := range map[string][]byte{
+		"malformed": []byte(`{"method":"isPrime","number":bad}`),
+		"oversize":  []byte(`{"method":"isPrime","number":1` + strings.Repeat("0", 9000) + `}`),
+	} {
+		reply := sendDatagram(t, payload)
+
+		var result struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(reply, &result); err != nil || result.Error == "" {
+			t.Errorf("Expected error reply for %s datagram, got %s", name, reply)
+		}
+	}
+}
+
+func TestUDPBoundsReplySize(t *testing.T) {
+	// The method list is several times the size of the request for it.
+	reply := sendDatagram(t, []byte(`{"method":"listMethods"}`))
+	var result struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(reply, &result); err != nil || result.Error != "response too large" {
+		t.Errorf("Expected response too large, got %s", reply)
+	}
+
+	// A datagram too short to carry even the error gets no reply.
+	conn, err := net.Dial("udp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Failed to dial UDP: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(`{}`)); err != nil {
+		t.Fatalf("Failed to send datagram: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 1024)
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("Expected no reply to a tiny datagram, got %q", buf[:n])
+	}
+}
+
+// refusedKeepsConnection sends requests on one connection and expects every
+// reply but the last to succeed and the last to be an error line containing
+// want, after which a cheap request must still be served.
+func refusedKeepsConnection(t *testing.T, method, want string, requests ...string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", "localhost:9000")
+	if err != nil {
+		t.Fatalf("Connection error: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	var line string
+	for _, req := range requests {
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatalf("Failed to write to connection: %v", err)
+		}
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Fatalf("Expected a response line, got error: %v", err)
+		}
+	}
+	var refused struct {
+		Method string `json:"method"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(line), &refused); err != nil {
+		t.Fatalf("Invalid JSON in response: %v", err)
+	}
+	if refused.Method != method || !strings.Contains(refused.Error, want) {
+		t.Errorf("Expected %q error, got %s", want, line)
+	}
+
+	// Cheap requests on the same connection are still served.
+	if _, err := conn.Write([]byte(`{"method":"isPrime","number":7}` + "\n")); err != nil {
+		t.Fatalf("Failed to write to connection: %v", err)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Connection closed after refusal: %v", err)
+	}
+	var result response
+	if err := json.Unmarshal([]byte(line), &result); err != nil || !result.Prime {
+		t.Errorf("Unexpected response after refusal: %s", line)
+	}
+}
+
+func TestThrottledRequestKeepsConnection(t *testing.T) {
+	// The largest modPow fits in a connection's default burst, but not twice.
+	huge := new(big.Int).Lsh(big.NewInt(1), 4095)
+	req := fmt.Sprintf(`{"method":"modPow","base":3,"exponent":%s,"modulus":%s}`, huge, new(big.Int).Add(huge, big.NewInt(1)))
+	refusedKeepsConnection(t, "modPow", "rate limited", req, req)
+}
+
+func TestTooExpensiveRequestKeepsConnection(t *testing.T) {
+	// A 5000-digit isPrime costs more than a connection can ever spend.
+	req := `{"method":"isPrime","number":1` + strings.Repeat("0", 4999) + `}`
+	refusedKeepsConnection(t, "isPrime", "request too expensive", req)
+}
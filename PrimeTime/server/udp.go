@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/bhaski-1234/protohackers/PrimeTime/config"
+)
+
+// maxBatchSize bounds the number of requests in one datagram.
+const maxBatchSize = 64
+
+// maxAmplification bounds the size of a reply as a multiple of the size of
+// the datagram it answers.
+const maxAmplification = 2
+
+// udpServer answers datagrams holding either one JSON request or a JSON
+// array of requests with a single datagram. Refused requests are answered
+// with an errorResponse as over TCP, but there is no connection to close.
+type udpServer struct {
+	conn    net.PacketConn
+	sources *limiter
+	dropped int
+}
+
+func newUDPServer() (*udpServer, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", config.Host, config.Port))
+	if err != nil {
+		return nil, err
+	}
+	return &udpServer{
+		conn:    conn,
+		sources: newLimiter(config.UDPRate, config.UDPBurst),
+	}, nil
+}
+
+func (s *udpServer) serve() {
+	log.Printf("Listening for UDP on %s:%d", config.Host, config.Port)
+
+	// One spare byte tells a datagram of exactly the limit from a larger one
+	// that the kernel truncated.
+	buf := make([]byte, config.MaxDatagramSize+1)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("Error reading datagram:", err)
+			continue
+		}
+
+		// Replies go to an address that may be spoofed, so sources over their
+		// budget get nothing back.
+		if !s.sources.allow(sourceKey(addr), 1) {
+			s.dropped++
+			if s.dropped%1000 == 1 {
+				log.Printf("Rate limited %s (%d datagrams dropped so far)", addr, s.dropped)
+			}
+			continue
+		}
+
+		var reply []byte
+		if n > config.MaxDatagramSize {
+			reply = marshalError("", fmt.Errorf("datagram exceeds %d bytes", config.MaxDatagramSize))
+		} else {
+			reply = handleDatagram(buf[:n], ipBudget(sourceKey(addr)))
+		}
+
+		// Never answer with much more than the client sent, so the listener
+		// cannot be used to amplify traffic. A datagram too small even for
+		// the error goes unanswered.
+		if limit := maxAmplification * n; len(reply) > limit {
+			reply = marshalError("", errors.New("response too large"))
+			if len(reply) > limit {
+				continue
+			}
+		}
+		if _, err := s.conn.WriteTo(reply, addr); err != nil {
+			fmt.Println("Error writing datagram:", err)
+		}
+	}
+}
+
+func sourceKey(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+func handleDatagram(data []byte, b budget) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		return handleOne(data, b)
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return marshalError("", err)
+	}
+	if len(batch) > maxBatchSize {
+		return marshalError("", fmt.Errorf("batch exceeds %d requests", maxBatchSize))
+	}
+
+	replies := make([]json.RawMessage, len(batch))
+	for i, item := range batch {
+		replies[i] = handleOne(item, b)
+	}
+	out, _ := json.Marshal(replies)
+	return out
+}
+
+func handleOne(data []byte, b budget) []byte {
+	var req request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return marshalError("", err)
+	}
+
+	resp, err := methods.dispatch(req, b)
+	if err != nil {
+		return marshalError(req.Method, err)
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return marshalError(req.Method, err)
+	}
+	return out
+}
+
+func marshalError(method string, err error) []byte {
+	out, _ := json.Marshal(errorResponse{Method: method, Error: err.Error()})
+	return out
+}